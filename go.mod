@@ -16,6 +16,7 @@ require (
 	go.opencensus.io v0.24.0
 	golang.org/x/crypto v0.19.0
 	golang.org/x/net v0.19.0
+	golang.org/x/sys v0.17.0
 	google.golang.org/grpc v1.56.3
 	google.golang.org/grpc/stats/opencensus v1.0.0
 	google.golang.org/protobuf v1.31.0
@@ -42,7 +43,6 @@ require (
 	github.com/spf13/cast v1.6.0 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/subosito/gotenv v1.6.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
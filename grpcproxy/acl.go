@@ -0,0 +1,290 @@
+package grpcproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// ACL rule is a string "host[:ports]" where
+// - host is a domain glob like "example.com", "*.example.com" or "*",
+//   or a CIDR like "10.0.0.0/8", "[2001:db8::/32]" (brackets are needed for IPv6 with ports),
+//   or an IP like "10.1.2.3", "::1", which is /32 (/128)
+// - ports are like "443", "80,443", "8000-9000" or "*"; any port if omitted
+// e.g. "*:80,443" allows only HTTP(S) ports
+
+type portRange struct {
+	from, to int
+}
+
+type ACLRule struct {
+	Text string
+
+	domain string
+	cidr   *net.IPNet
+	ports  []portRange
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	if s == "" || s == "*" {
+		return nil, nil
+	}
+
+	var lst []portRange
+	for _, item := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+
+		pFrom, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", item)
+		}
+		pTo, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("bad port %q", item)
+		}
+		if pFrom < 0 || pTo > 65535 || pFrom > pTo {
+			return nil, fmt.Errorf("bad port range %q", item)
+		}
+
+		lst = append(lst, portRange{pFrom, pTo})
+	}
+
+	return lst, nil
+}
+
+func ParseACLRule(s string) (ACLRule, error) {
+	rule := ACLRule{Text: s}
+
+	host, ports := s, ""
+	switch {
+	case strings.HasPrefix(s, "["):
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return rule, fmt.Errorf("acl rule %q: missing ']'", s)
+		}
+		host = s[1:i]
+		ports = strings.TrimPrefix(s[i+1:], ":")
+	case strings.Count(s, ":") == 1:
+		host, ports, _ = strings.Cut(s, ":")
+	}
+
+	var err error
+	rule.ports, err = parsePorts(ports)
+	if err != nil {
+		return rule, fmt.Errorf("acl rule %q: %v", s, err)
+	}
+
+	if host == "" {
+		host = "*"
+	}
+
+	if strings.Contains(host, "/") {
+		_, rule.cidr, err = net.ParseCIDR(host)
+		if err != nil {
+			return rule, fmt.Errorf("acl rule %q: %v", s, err)
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		// a single IP is /32 (/128), so names resolving to it match too
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		rule.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		rule.domain = normalizeHost(host)
+		if _, err := path.Match(rule.domain, ""); err != nil {
+			return rule, fmt.Errorf("acl rule %q: %v", s, err)
+		}
+	}
+
+	return rule, nil
+}
+
+func (r *ACLRule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+
+	for _, pr := range r.ports {
+		if pr.from <= port && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
+
+// Match checks host (and its resolved ips for CIDR rules) and port
+func (r *ACLRule) Match(host string, ips []net.IP, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+
+	if r.cidr != nil {
+		for _, ip := range ips {
+			if r.cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ok, _ := path.Match(r.domain, normalizeHost(host))
+	return ok
+}
+
+// normalizeHost makes "Example.COM." and "example.com" the same for domain rules
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type ACL struct {
+	Allow []ACLRule
+	Deny  []ACLRule
+}
+
+// aclJSON is how ACL is represented in POG_AUTH_* items and POG_ACL_FILE
+type aclJSON struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func parseACL(aj aclJSON) (*ACL, error) {
+	if len(aj.Allow) == 0 && len(aj.Deny) == 0 {
+		return nil, nil
+	}
+
+	acl := &ACL{}
+	for _, s := range aj.Allow {
+		rule, err := ParseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.Allow = append(acl.Allow, rule)
+	}
+	for _, s := range aj.Deny {
+		rule, err := ParseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.Deny = append(acl.Deny, rule)
+	}
+
+	return acl, nil
+}
+
+// aclDefaultRule is reported when the destination matches no allow rule
+const aclDefaultRule = "<not allowed>"
+
+// Check returns false and the rule which denies the destination;
+// deny rules go first, then the destination has to match an allow rule (if any);
+// nil ACL allows everything
+func (acl *ACL) Check(host string, ips []net.IP, port int) (string, bool) {
+	if acl == nil {
+		return "", true
+	}
+
+	for _, rule := range acl.Deny {
+		if rule.Match(host, ips, port) {
+			return rule.Text, false
+		}
+	}
+
+	if len(acl.Allow) == 0 {
+		return "", true
+	}
+
+	for _, rule := range acl.Allow {
+		if rule.Match(host, ips, port) {
+			return "", true
+		}
+	}
+
+	return aclDefaultRule, false
+}
+
+// NeedsIPs tells if the destination host name is to be resolved for the check
+func (acl *ACL) NeedsIPs() bool {
+	if acl == nil {
+		return false
+	}
+
+	for _, lst := range [][]ACLRule{acl.Allow, acl.Deny} {
+		for _, rule := range lst {
+			if rule.cidr != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACLPolicy maps account names to their ACLs; "*" is for accounts without one
+type ACLPolicy map[string]*ACL
+
+const aclAnyAccount = "*"
+
+func (p ACLPolicy) ForUser(user string) *ACL {
+	if acl, ok := p[user]; ok {
+		return acl
+	}
+	return p[aclAnyAccount]
+}
+
+// MakeACLPolicy collects ACLs from auth items and the policy file (if any),
+// the file has the form {"account": {"allow": [...], "deny": [...]}, "*": {...}};
+// an auth item' own ACL wins over the file
+func MakeACLPolicy(authLst []AuthItem, policyFile string) (ACLPolicy, error) {
+	policy := ACLPolicy{}
+
+	if policyFile != "" {
+		b, err := os.ReadFile(policyFile)
+		if err != nil {
+			util.Errorf("failed to read ACL file: %v", err)
+			return nil, err
+		}
+
+		var m map[string]aclJSON
+		if err := json.Unmarshal(b, &m); err != nil {
+			err = fmt.Errorf("failed to parse ACL file %s: %v", policyFile, err)
+			util.Error(err)
+			return nil, err
+		}
+
+		for name, aj := range m {
+			acl, err := parseACL(aj)
+			if err != nil {
+				util.Error(err)
+				return nil, err
+			}
+			policy[name] = acl
+		}
+	}
+
+	for _, ai := range authLst {
+		acl, err := parseACL(aclJSON{Allow: ai.Allow, Deny: ai.Deny})
+		if err != nil {
+			err = fmt.Errorf("failed to parse ACL of %v auth item: %v", ai.Name, err)
+			util.Error(err)
+			return nil, err
+		}
+		if acl != nil {
+			policy[ai.Name] = acl
+		}
+	}
+
+	return policy, nil
+}
+
+var aclDeniedCnt = util.MakeCounterVecFunc(
+	"acl_denied_total",
+	"Number of connections denied by ACL rules, by rule",
+)
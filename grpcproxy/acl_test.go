@@ -0,0 +1,83 @@
+package grpcproxy
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl, err := parseACL(aclJSON{
+		Allow: []string{"*:80,443", "10.0.0.0/8", "*.example.com:8000-9000", "::1", "192.168.1.1:22"},
+		Deny:  []string{"*.internal.example.com", "[2001:db8::/32]:443"},
+	})
+	require.NoError(t, err)
+	require.True(t, acl.NeedsIPs())
+
+	ip := func(s string) []net.IP {
+		return []net.IP{net.ParseIP(s)}
+	}
+
+	for _, tc := range []struct {
+		host string
+		ips  []net.IP
+		port int
+		rule string
+		ok   bool
+	}{
+		{"ifconfig.me", nil, 443, "", true},
+		{"ifconfig.me", nil, 22, aclDefaultRule, false},
+		{"a.Example.com", nil, 8080, "", true},
+		{"example.com", nil, 8080, aclDefaultRule, false},
+		{"db.internal.example.com", nil, 443, "*.internal.example.com", false},
+		{"db.internal.example.com.", nil, 443, "*.internal.example.com", false},
+		{"DB.Internal.example.com.", nil, 443, "*.internal.example.com", false},
+		{"db", ip("10.1.2.3"), 5432, "", true},
+		{"2001:db8::1", ip("2001:db8::1"), 443, "[2001:db8::/32]:443", false},
+		{"2001:db8::1", ip("2001:db8::1"), 80, "", true},
+		{"::1", ip("::1"), 5432, "", true},
+		{"::2", ip("::2"), 5432, aclDefaultRule, false},
+		{"gw", ip("192.168.1.1"), 22, "", true},
+		{"gw", ip("192.168.1.2"), 22, aclDefaultRule, false},
+	} {
+		rule, ok := acl.Check(tc.host, tc.ips, tc.port)
+		require.Equal(t, tc.ok, ok, tc)
+		require.Equal(t, tc.rule, rule, tc)
+	}
+
+	for _, s := range []string{"[::1", "*:http", "300.0.0.0/8", "[a-", "*:443-80", "*:65536", "*:0-70000"} {
+		_, err := ParseACLRule(s)
+		require.Error(t, err, s)
+	}
+
+	var nilACL *ACL
+	_, ok := nilACL.Check("ifconfig.me", nil, 22)
+	require.True(t, ok)
+}
+
+func TestACLDenied(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	cfg := makeTestServerConfig(t)
+	acl, err := parseACL(aclJSON{Allow: []string{"*:443"}})
+	require.NoError(t, err)
+	cfg.ACL = ACLPolicy{aclAnyAccount: acl}
+
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	resp, err := client.Get("http://" + echoAddr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", echoAddr)
+	require.ErrorContains(t, err, "not allowed")
+}
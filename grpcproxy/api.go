@@ -20,6 +20,12 @@ type Stream interface {
 	Recv() (*pb.Packet, error)
 }
 
+// ClientStream is the client end of a Run stream or of a logical Mux stream
+type ClientStream interface {
+	Stream
+	CloseSend() error
+}
+
 func isEndError(err error) bool {
 	// our cancel() errors can be converted to gRPC' Canceled errors
 	// - on client: when we call cancel() on a context used for a client stream =>
@@ -106,12 +112,14 @@ func (t *streamWriter) Write(p []byte) (int, error) {
 }
 
 func NewStreamReader(s Stream) io.Reader {
-	return &streamReader{s, &bytes.Buffer{}}
+	return &streamReader{s: s, buf: &bytes.Buffer{}}
 }
 
 type streamReader struct {
 	s   Stream
 	buf *bytes.Buffer
+
+	eof bool // got EndOfStream
 }
 
 func (t *streamReader) Read(p []byte) (int, error) {
@@ -122,12 +130,26 @@ func (t *streamReader) Read(p []byte) (int, error) {
 		return n, nil
 	}
 
+	if t.eof {
+		return 0, io.EOF
+	}
+
 	// buffer is empty
 	packet, err := Recv(t.s)
 	if err != nil {
+		// the stream is over without EndOfStream, so it is
+		// an abort (or an old peer), not a half-close
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return 0, err
 	}
 
+	if _, ok := packet.Union.(*pb.Packet_EndOfStream); ok {
+		t.eof = true
+		return 0, io.EOF
+	}
+
 	resp, err := castFromUnion[*pb.Packet_Payload](packet)
 	if err != nil {
 		return 0, err
@@ -145,38 +167,81 @@ func (t *streamReader) Read(p []byte) (int, error) {
 	return t.buf.Read(p)
 }
 
+func newEndOfStreamPacket() *pb.Packet {
+	return &pb.Packet{
+		Union: &pb.Packet_EndOfStream{
+			EndOfStream: &pb.EndOfStream{},
+		},
+	}
+}
+
+func closeWrite(conn net.Conn) error {
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return fmt.Errorf("%T does not support CloseWrite()", conn)
+	}
+
+	return cw.CloseWrite()
+}
+
 var TunnelingConnections = util.NewGaugeVecMetric(
 	"tunnelling_connections_total",
 	"Number of connections tunneling through the proxy.",
 	[]string{},
 ).With(prometheus.Labels{})
 
-func handleBinaryTunneling(stream Stream, conn net.Conn, streamCancel context.CancelFunc) {
+func handleBinaryTunneling(stream Stream, conn net.Conn, streamCancel context.CancelFunc, limits tunnelLimits) {
 	TunnelingConnections.Inc()
 	defer TunnelingConnections.Dec()
 
 	var wg sync.WaitGroup
 
-	// when conn-side closes we close writer, and also we need to finish the transfer() goroutine
-	// with the reader => we use `cancel` func to close the stream (client) or initiate close action
+	// we use `cancel` func to close the stream (client) or initiate close action
 	// (server: get out of grpc operation loop)
-	transfer(NewStreamWriter(stream), conn, &wg, streamCancel)
-	transfer(conn, NewStreamReader(stream), &wg, func() {
-		conn.Close()
+	// done wakes the copiers waiting for rate limits
+	done := make(chan struct{})
+	var teardownOnce sync.Once
+	teardown := func() {
+		teardownOnce.Do(func() {
+			close(done)
+			streamCancel()
+			conn.Close()
+		})
+	}
+
+	// every direction ends on its own (TCP half-close): conn-side EOF goes
+	// as EndOfStream packet, and EndOfStream packet makes CloseWrite() for conn;
+	// any failure tears the whole tunnel down
+	transfer(NewStreamWriter(stream), limits.wrapReader(conn, limits.FromConn, done), &wg, func(err error) {
+		if err == nil {
+			err = Send(stream, newEndOfStreamPacket())
+		}
+		if err != nil {
+			teardown()
+		}
+	})
+	transfer(conn, limits.wrapReader(NewStreamReader(stream), limits.ToConn, done), &wg, func(err error) {
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		if err != nil {
+			teardown()
+		}
 	})
 
 	wg.Wait()
+	teardown()
 }
 
-func transfer(destination io.Writer, source io.Reader, wg *sync.WaitGroup, cancel context.CancelFunc) {
+// transfer copies source to destination in a goroutine, and calls onDone
+// with the io.Copy() result (nil for EOF)
+func transfer(destination io.Writer, source io.Reader, wg *sync.WaitGroup, onDone func(err error)) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer func() {
-			if cancel != nil {
-				cancel()
-			}
-		}()
-		io.Copy(destination, source)
+		_, err := io.Copy(destination, source)
+		onDone(err)
 	}()
 }
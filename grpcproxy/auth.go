@@ -23,6 +23,17 @@ var (
 )
 
 func isAuthenticated(authorization string, authLst []AuthItem) (string, error) {
+	creds, err := decodeBasicAuth(authorization)
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.Index(creds, ":")
+	return checkUserPassword(creds[:i], creds[i+1:], authLst)
+}
+
+// decodeBasicAuth returns "user:password" of Basic authorization
+func decodeBasicAuth(authorization string) (string, error) {
 	tokenBase64 := strings.TrimPrefix(authorization, "Basic ")
 
 	b, err := base64.StdEncoding.DecodeString(tokenBase64)
@@ -31,13 +42,13 @@ func isAuthenticated(authorization string, authLst []AuthItem) (string, error) {
 	}
 
 	creds := string(b)
-	i := strings.Index(creds, ":")
-	if i < 0 {
+	if !strings.Contains(creds, ":") {
 		return "", fmt.Errorf("token %q misses ':' for the formatting user:password", tokenBase64)
 	}
-	user := creds[:i]
-	pass := creds[i+1:]
+	return creds, nil
+}
 
+func checkUserPassword(user, pass string, authLst []AuthItem) (string, error) {
 	for _, aui := range authLst {
 		if aui.Name != user {
 			continue
@@ -127,6 +138,33 @@ type AuthItem struct {
 
 	ExpDateStr string    `json:"exp_date"`
 	ExpDate    time.Time `json:"-"`
+
+	// destination ACL rules (server side), see ParseACLRule()
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// bandwidth limit, bytes per second for each direction; 0 is unlimited
+	RateLimit int64 `json:"rate_limit,omitempty"`
+
+	// traffic quota, bytes per quota period for both directions; 0 is unlimited
+	Quota       int64  `json:"quota,omitempty"`
+	QuotaPeriod string `json:"quota_period,omitempty"` // "day" or "month" (default), UTC
+
+	// concurrent tunnels limit; overrides MAX_TUNNELS_PER_USER (CLIENT_MAX_TUNNELS_PER_USER)
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+
+	// local IPs/interfaces to connect to destinations from (server side), see EgressSourcePolicy
+	EgressSource      []string           `json:"egress_source,omitempty"`
+	EgressSourceRules []EgressSourceRule `json:"egress_source_rules,omitempty"`
+
+	// name of the next hop pog server for all tunnels of the account, see NextHopRouter
+	NextHop string `json:"next_hop,omitempty"`
+
+	// reverse listeners the account may register, overrides REVERSE_ALLOW; see ReverseListeners
+	Reverse []string `json:"reverse,omitempty"`
+
+	// user:password at the pog server for the CLIENT_AUTH_* user (client side), see POGAuthMap
+	POGAuth string `json:"pog_auth,omitempty"`
 }
 
 func hashPassword(password string) (string, error) {
@@ -209,12 +247,13 @@ type BasicAuthCredentials struct {
 	Auth string
 }
 
-// GetRequestMetadata gets the request metadata as a map from a TokenSource.
+// GetRequestMetadata gets the request metadata as a map from a TokenSource;
+// nothing if the stream goes with an end-user' credentials, see POGAuthMap
 func (ts BasicAuthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	s := base64.StdEncoding.EncodeToString([]byte(ts.Auth))
-	return map[string]string{
-		"authorization": "Basic " + s,
-	}, nil
+	if pogAuthFromContext(ctx) != "" {
+		return nil, nil
+	}
+	return basicAuthMetadata(ts.Auth), nil
 }
 
 func (ts BasicAuthCredentials) RequireTransportSecurity() bool {
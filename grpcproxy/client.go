@@ -1,12 +1,16 @@
 package grpcproxy
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
 	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
@@ -24,17 +28,121 @@ func httpError(w http.ResponseWriter, errMsg string, code int) {
 	fmt.Fprintln(w, errMsg)
 }
 
-func checkProxyAuth(r *http.Request, authLst []AuthItem) (string, error) {
+// checkProxyAuth returns the user and "user:password" of Proxy-Authorization
+func checkProxyAuth(r *http.Request, authLst []AuthItem) (string, string, error) {
 	if len(authLst) == 0 {
-		return "anonymous", nil
+		return "anonymous", "", nil
 	}
 
 	value, ok := r.Header["Proxy-Authorization"]
 	if !ok {
-		return "", fmt.Errorf("Proxy-Authorization header required")
+		return "", "", fmt.Errorf("Proxy-Authorization header required")
 	}
 
-	return isAuthenticated(value[0], authLst)
+	user, err := isAuthenticated(value[0], authLst)
+	if err != nil {
+		return "", "", err
+	}
+	userPass, _ := decodeBasicAuth(value[0])
+	return user, userPass, nil
+}
+
+// ConnectError is an error the pog server has reported via ConnectResponse
+type ConnectError struct {
+	HTTPError *pb.HTTPError
+	Err       error // the cause if the client dialed on its own, see openDirectTunnel()
+}
+
+func (e *ConnectError) Error() string {
+	return e.HTTPError.Error
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// tunnelErrorCode maps an openTunnel() error to HTTP status code
+func tunnelErrorCode(err error) int {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return int(connectErr.HTTPError.StatusCode)
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unauthenticated:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+func closeSend(stream ClientStream) {
+	if err := stream.CloseSend(); err != nil {
+		util.Errorf("stream.CloseSend failed: %v", err)
+	}
+}
+
+// openTunnel connects to hostPort the way ClientRouter chooses, via pog by default;
+// ctx controls the lifetime of the stream
+func openTunnel(ctx context.Context, pcc *ProxyClientContext, hostPort string) (ClientStream, error) {
+	stream, _, err := openRoutedTunnel(ctx, pcc, hostPort)
+	return stream, err
+}
+
+// openTunnelViaPOG starts a Run stream and asks the pog server to connect to hostPort
+func openTunnelViaPOG(ctx context.Context, pcc *ProxyClientContext, hostPort string) (ClientStream, error) {
+	packet := &pb.Packet{
+		Union: &pb.Packet_ConnectRequest{
+			ConnectRequest: &pb.ConnectRequest{
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	return openStream(ctx, pcc, packet)
+}
+
+// openStream starts a Run stream with the request packet and waits for ConnectResponse
+func openStream(ctx context.Context, pcc *ProxyClientContext, packet *pb.Packet) (ClientStream, error) {
+	if pcc.Pool != nil {
+		return pcc.Pool.openStream(ctx, packet)
+	}
+	return openStreamVia(ctx, pcc, packet)
+}
+
+type streamOpener interface {
+	newStream(ctx context.Context) (ClientStream, error)
+}
+
+func openStreamVia(ctx context.Context, opener streamOpener, packet *pb.Packet) (ClientStream, error) {
+	stream, err := opener.newStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("grpc connection failed: %w", err)
+	}
+
+	if err := Send(stream, packet); err != nil {
+		closeSend(stream)
+		return nil, fmt.Errorf("grpc i/o failure: %w", err)
+	}
+
+	pktResp, err := Recv(stream)
+	if err != nil {
+		closeSend(stream)
+		return nil, fmt.Errorf("grpc i/o failure: %w", err)
+	}
+
+	resp, err := castFromUnion[*pb.Packet_ConnectResponse](pktResp)
+	if err != nil {
+		closeSend(stream)
+		return nil, err
+	}
+
+	if err := resp.ConnectResponse.Error; err != nil {
+		closeSend(stream)
+		return nil, &ConnectError{HTTPError: err}
+	}
+
+	return stream, nil
 }
 
 func handleTunneling(w http.ResponseWriter, r *http.Request, pcc *ProxyClientContext) {
@@ -42,12 +150,15 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, pcc *ProxyClientCon
 	defer cancel()
 
 	user := "-"
+	var route tunnelRoute
 	logReq := func(code int) {
 		logRequest(LogRecord{
 			ConnectAddr: r.Host,
 			User:        user,
 			RemoteAddr:  r.RemoteAddr,
 			Code:        strconv.Itoa(code),
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
 		})
 	}
 
@@ -64,12 +175,7 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, pcc *ProxyClientCon
 				continue
 			}
 
-			if status.Code(err) == codes.Unavailable {
-				code = http.StatusServiceUnavailable
-			}
-			if status.Code(err) == codes.Unauthenticated {
-				code = http.StatusServiceUnavailable
-			}
+			code = tunnelErrorCode(err)
 		}
 
 		errMsg = fmt.Sprintf(errMsg, a...)
@@ -77,55 +183,27 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, pcc *ProxyClientCon
 		httpErrorAndLog(w, errMsg, code)
 	}
 
-	user, err := checkProxyAuth(r, pcc.AuthLst)
+	user, userPass, err := checkProxyAuth(r, pcc.AuthLst)
 	if err != nil {
 		w.Header().Set("Proxy-Authenticate", `Basic realm="CLIENT_AUTH_* list"`)
 		httpErrorAndLog(w, err.Error(), http.StatusProxyAuthRequired)
 		return
 	}
+	ctx = pcc.POGAuth.withUser(ctx, user, userPass)
 
-	client := pcc.Client
-
-	stream, err := client.Run(ctx)
-	if err != nil {
-		bailOut("grpc connection failed: %v", err)
-		return
-	}
-	defer func() {
-		if err := stream.CloseSend(); err != nil {
-			util.Errorf("stream.CloseSend failed: %v", err)
-		}
-	}()
-
-	hostPort := r.Host
-	packet := &pb.Packet{
-		Union: &pb.Packet_ConnectRequest{
-			ConnectRequest: &pb.ConnectRequest{
-				HostPort: hostPort,
-			},
-		},
-	}
-	if err := Send(stream, packet); err != nil {
-		bailOut("grpc i/o failure: %v", err)
-		return
-	}
-
-	pktResp, err := Recv(stream)
+	release, err := pcc.TunnelCaps.Acquire(user, "")
 	if err != nil {
-		bailOut("grpc i/o failure: %v", err)
+		httpErrorAndLog(w, status.Convert(err).Message(), http.StatusTooManyRequests)
 		return
 	}
+	defer release()
 
-	resp, err := castFromUnion[*pb.Packet_ConnectResponse](pktResp)
+	stream, route, err := openRoutedTunnel(ctx, pcc, r.Host)
 	if err != nil {
-		bailOut(err.Error())
-		return
-	}
-
-	if err := resp.ConnectResponse.Error; err != nil {
-		httpErrorAndLog(w, err.Error, int(err.StatusCode))
+		bailOut("%v", err)
 		return
 	}
+	defer closeSend(stream)
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -143,7 +221,7 @@ func handleTunneling(w http.ResponseWriter, r *http.Request, pcc *ProxyClientCon
 	defer clientConn.Close()
 	logReq(http.StatusOK)
 
-	handleBinaryTunneling(stream, clientConn, cancel)
+	handleBinaryTunneling(stream, clientConn, cancel, pcc.RateLimits.clientTunnelLimits(user))
 }
 
 func ProxyHandler(w http.ResponseWriter, r *http.Request, pcc *ProxyClientContext) {
@@ -152,12 +230,16 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request, pcc *ProxyClientContex
 		return
 	}
 
+	// absolute-form requests are to be proxied, even for /metrics path
+	if r.URL.IsAbs() {
+		handleHTTP(w, r, pcc)
+		return
+	}
+
 	if HandleMux(w, r, pcc.MetricsMux) {
 		return
 	}
 
-	// :TODO:
-	//handleHTTP(w, r, client)
 	httpError(w, "Not implemented", http.StatusNotImplemented)
 }
 
@@ -165,7 +247,38 @@ type ProxyClientContext struct {
 	Client  pb.HTTPProxyClient
 	AuthLst []AuthItem
 
+	// tunnels go via a shared Mux stream if set, see EnableMux()
+	mux *muxClient
+
+	// several pog servers instead of Client if set
+	Pool *ServerPool
+
 	MetricsMux *http.ServeMux
+
+	// bandwidth limits per CLIENT_AUTH_* user and for the whole client
+	RateLimits *RateLimits
+
+	// concurrent tunnels limits per CLIENT_AUTH_* user
+	TunnelCaps *TunnelCaps
+
+	// direct/pog/reject rules, all tunnels go via pog if nil
+	Router *ClientRouter
+
+	// what to do if pog is unavailable, 503 if nil
+	Fallback *FallbackPolicy
+
+	// named pog servers chosen by destination, all tunnels go via Client or Pool if nil
+	Servers *ServerRouter
+
+	// pog server accounts of CLIENT_AUTH_* users, all go with CLIENT_POG_AUTH if nil
+	POGAuth *POGAuthMap
+
+	// limits protocol detection and SOCKS handshake of silent clients, none if 0
+	SOCKSHandshakeTimeout time.Duration
+
+	// keep-alive connections of plain HTTP proxying per user, see handleHTTP()
+	userTransportsMu sync.Mutex
+	userTransports   map[string]userTransport // by user name
 }
 
 func NewProxyClientContext(client pb.HTTPProxyClient) (*ProxyClientContext, error) {
@@ -176,5 +289,37 @@ func NewProxyClientContext(client pb.HTTPProxyClient) (*ProxyClientContext, erro
 	return &ProxyClientContext{
 		Client:  client,
 		AuthLst: authLst,
+
+		SOCKSHandshakeTimeout: defaultSOCKSHandshakeTimeout,
 	}, nil
 }
+
+// EnableMux makes tunnels share a single Mux stream instead of a Run stream
+// per tunnel; it falls back to Run streams if the server does not support Mux
+func (pcc *ProxyClientContext) EnableMux() {
+	if pcc.Pool != nil {
+		pcc.Pool.enableMux()
+		return
+	}
+	pcc.mux = &muxClient{client: pcc.Client}
+}
+
+func (pcc *ProxyClientContext) newStream(ctx context.Context) (ClientStream, error) {
+	return newStreamVia(ctx, pcc.Client, pcc.mux)
+}
+
+func newStreamVia(ctx context.Context, client pb.HTTPProxyClient, mux *muxClient) (ClientStream, error) {
+	// the shared Mux stream goes with the connection' credentials
+	auth := pogAuthFromContext(ctx)
+	if mux != nil && auth == "" {
+		stream, err := mux.newStream(ctx)
+		if err != errMuxUnsupported {
+			return stream, err
+		}
+	}
+
+	if auth != "" {
+		return client.Run(ctx, grpc.PerRPCCredentials(userAuthCredentials(auth)))
+	}
+	return client.Run(ctx)
+}
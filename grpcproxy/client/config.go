@@ -1,9 +1,18 @@
 package main
 
-import "git.catbo.net/muravjov/go2023/util"
+import (
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
 
 type Config struct {
-	ServerAddr string // proxy-over-grpc server address (host:port)
+	ServerAddr string // proxy-over-grpc server address (host:port), or a comma-separated list, "srv:name" for SRV records
+
+	ServerPolicy        string        // how to choose among several servers: priority, round-robin or least-latency [priority]
+	HealthcheckInterval time.Duration // how often several servers are checked [10s]
+
+	ServerRules string // comma-separated "<server name> <ACL rule>" items choosing CLIENT_POG_SERVER_* servers, default (ServerAddr) if none
 
 	// TLS settings
 	ServerHost string // Host name to which server IP should resolve
@@ -12,20 +21,82 @@ type Config struct {
 
 	ClientListen string // this proxy-over-grpc client address to listen to [host]:port
 
+	ClientSOCKSListen string // separate SOCKS5/SOCKS4a address to listen to [host]:port, none if empty
+	SOCKSAutoDetect   bool   // serve SOCKS on ClientListen too [true]
+
 	ClientPOGAuth string // auth string to connect to server, in the form user:password
+
+	POGAuthPassthrough bool // CLIENT_AUTH_* users without pog_auth go to server with their own credentials [false]
+
+	RateLimit int // bandwidth limit of all tunnels, bytes per second for each direction, 0 is unlimited [0]
+
+	MaxTunnelsPerUser int // concurrent tunnels limit per CLIENT_AUTH_* user, 0 is unlimited [0]
+
+	Mux bool // multiplex all tunnels over a single gRPC stream [false]
+
+	Conns       int // gRPC connections per server [1]
+	MaxConns    int // gRPC connections per server to grow to on demand, no growth if not above Conns [0]
+	ConnStreams int // active streams per gRPC connection to grow at [100]
+
+	Reverse string // reverse tunnels, comma-separated remote=target items, remote is a host name or :port
+
+	Forward string // static port forwarding, comma-separated listen=target items, listen is a port or host:port
+
+	TransparentListen       string        // address for connections redirected by iptables (Linux), none if empty
+	TransparentMode         string        // redirect (REDIRECT target) or tproxy (TPROXY target) [redirect]
+	TransparentSniffTimeout time.Duration // how long to wait for TLS SNI/HTTP Host, 0 disables [300ms]
+
+	RouteRules string // comma-separated "direct|pog|reject <ACL rule>" items, the first match wins, pog if none
+	NoProxy    string // NO_PROXY-style list of destinations to connect to directly
+
+	Fallback      string // if pog is unavailable: direct (dial directly) or strict (never dial directly), 503 if empty
+	FallbackRules string // comma-separated "direct|strict <ACL rule>" items overriding Fallback per destination
+
+	PACFile  string // rules to serve /proxy.pac and /wpad.dat from, none if empty
+	PACProxy string // PAC proxy string, e.g. "PROXY pog.lan:18080", the request' Host if empty
 }
 
 func MakeConfig() Config {
 	cfg := Config{}
 
 	util.StringEnv(&cfg.ServerAddr, "SERVER_ADDR", "")
+	util.StringEnv(&cfg.ServerPolicy, "SERVER_POLICY", "priority")
+	util.DurationEnv(&cfg.HealthcheckInterval, "SERVER_HEALTHCHECK_INTERVAL", 10*time.Second)
+	util.StringEnv(&cfg.ServerRules, "SERVER_RULES", "")
 
 	util.StringEnv(&cfg.ServerHost, "SERVER_HOST", "")
 	util.BoolEnv(&cfg.Insecure, "INSECURE", false)
 	util.BoolEnv(&cfg.SkipVerify, "SKIP_VERIFY", false)
 
 	util.StringEnv(&cfg.ClientListen, "CLIENT_LISTEN", ":18080")
+	util.StringEnv(&cfg.ClientSOCKSListen, "CLIENT_SOCKS_LISTEN", "")
+	util.BoolEnv(&cfg.SOCKSAutoDetect, "SOCKS_AUTO_DETECT", true)
 	util.StringEnv(&cfg.ClientPOGAuth, "CLIENT_POG_AUTH", "")
+	util.BoolEnv(&cfg.POGAuthPassthrough, "CLIENT_POG_AUTH_PASSTHROUGH", false)
+
+	util.IntEnv(&cfg.RateLimit, "RATE_LIMIT", 0)
+	util.IntEnv(&cfg.MaxTunnelsPerUser, "CLIENT_MAX_TUNNELS_PER_USER", 0)
+	util.BoolEnv(&cfg.Mux, "CLIENT_MUX", false)
+
+	util.IntEnv(&cfg.Conns, "CLIENT_CONNS", 1)
+	util.IntEnv(&cfg.MaxConns, "CLIENT_MAX_CONNS", 0)
+	util.IntEnv(&cfg.ConnStreams, "CLIENT_CONN_STREAMS", 100)
+
+	util.StringEnv(&cfg.Reverse, "CLIENT_REVERSE", "")
+	util.StringEnv(&cfg.Forward, "CLIENT_FORWARD", "")
+
+	util.StringEnv(&cfg.TransparentListen, "CLIENT_TRANSPARENT_LISTEN", "")
+	util.StringEnv(&cfg.TransparentMode, "CLIENT_TRANSPARENT_MODE", "redirect")
+	util.DurationEnv(&cfg.TransparentSniffTimeout, "CLIENT_TRANSPARENT_SNIFF_TIMEOUT", 300*time.Millisecond)
+
+	util.StringEnv(&cfg.RouteRules, "CLIENT_ROUTE_RULES", "")
+	util.StringEnv(&cfg.NoProxy, "CLIENT_NO_PROXY", "")
+
+	util.StringEnv(&cfg.Fallback, "CLIENT_FALLBACK", "")
+	util.StringEnv(&cfg.FallbackRules, "CLIENT_FALLBACK_RULES", "")
+
+	util.StringEnv(&cfg.PACFile, "CLIENT_PAC_FILE", "")
+	util.StringEnv(&cfg.PACProxy, "CLIENT_PAC_PROXY", "")
 
 	return cfg
 }
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -74,17 +76,103 @@ func Main() bool {
 		opts = append(opts, grpc.WithPerRPCCredentials(grpcproxy.BasicAuthCredentials{Auth: cfg.ClientPOGAuth}))
 	}
 
-	conn, err := grpc.Dial(cfg.ServerAddr, opts...)
+	// a pool of gRPC connections per server
+	dial := func(addr string) (grpcproxy.ClientConn, error) {
+		return grpcproxy.NewConnPool(addr, grpcproxy.ConnPoolConfig{
+			Size:           cfg.Conns,
+			MaxSize:        cfg.MaxConns,
+			StreamsPerConn: cfg.ConnStreams,
+		}, func(addr string) (*grpc.ClientConn, error) {
+			return grpc.Dial(addr, opts...)
+		})
+	}
+
+	var pcc *grpcproxy.ProxyClientContext
+	serverLst := strings.Split(cfg.ServerAddr, ",")
+	if len(serverLst) == 1 && !strings.HasPrefix(cfg.ServerAddr, "srv:") {
+		conn, err := dial(cfg.ServerAddr)
+		if err != nil {
+			util.Errorf("failed to dial server %s: %v", cfg.ServerAddr, err)
+			return false
+		}
+		defer conn.Close()
+		client := pb.NewHTTPProxyClient(conn)
+		pcc, err = grpcproxy.NewProxyClientContext(client)
+		if err != nil {
+			return false
+		}
+	} else {
+		addrs, err := grpcproxy.ResolveServerAddrs(serverLst)
+		if err != nil {
+			util.Error(err)
+			return false
+		}
+		util.Infof("pog servers: %s, policy %s", strings.Join(addrs, ", "), cfg.ServerPolicy)
+
+		pool, err := grpcproxy.NewServerPool(addrs, cfg.ServerPolicy, cfg.HealthcheckInterval, dial)
+		if err != nil {
+			util.Error(err)
+			return false
+		}
+		defer pool.Close()
+
+		pcc, err = grpcproxy.NewProxyClientContext(nil)
+		if err != nil {
+			return false
+		}
+		pcc.Pool = pool
+	}
+	if cfg.Mux {
+		pcc.EnableMux()
+	}
+	pcc.RateLimits = grpcproxy.NewRateLimits(int64(cfg.RateLimit), pcc.AuthLst)
+	pcc.TunnelCaps = grpcproxy.NewTunnelCaps(cfg.MaxTunnelsPerUser, 0, pcc.AuthLst)
+	pcc.POGAuth = grpcproxy.NewPOGAuthMap(pcc.AuthLst, cfg.POGAuthPassthrough)
+
+	router, err := grpcproxy.NewClientRouter(strings.Split(cfg.RouteRules, ","), strings.Split(cfg.NoProxy, ","))
+	if err != nil {
+		return false
+	}
+	pcc.Router = router
+
+	fallback, err := grpcproxy.NewFallbackPolicy(cfg.Fallback, strings.Split(cfg.FallbackRules, ","))
+	if err != nil {
+		return false
+	}
+	pcc.Fallback = fallback
+
+	servers, err := grpcproxy.ParseClientServers(grpcproxy.ClientServerEnvVarPrefix)
+	if err != nil {
+		return false
+	}
+	serverRouter, err := grpcproxy.NewServerRouter(servers, strings.Split(cfg.ServerRules, ","))
 	if err != nil {
-		util.Errorf("failed to dial server %s: %v", cfg.ServerAddr, err)
 		return false
 	}
-	defer conn.Close()
-	client := pb.NewHTTPProxyClient(conn)
-	pcc, err := grpcproxy.NewProxyClientContext(client)
+	defer serverRouter.Close()
+	pcc.Servers = serverRouter
+	if pcc.POGAuth != nil {
+		for _, server := range servers {
+			if !server.UserAuth {
+				util.Infof("pog server %s: users go with its own auth, not with pog_auth/passthrough ones (no user_auth)", server.Name)
+			}
+		}
+	}
+
+	if args := os.Args[1:]; len(args) > 0 {
+		return runCommand(args, pcc)
+	}
+
+	reverseTunnels, err := grpcproxy.ParseReverseTunnels(cfg.Reverse)
 	if err != nil {
+		util.Error(err)
 		return false
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, rt := range reverseTunnels {
+		go grpcproxy.ServeReverse(ctx, pcc, rt)
+	}
 
 	pcc.MetricsMux = (func() *http.ServeMux {
 		var muxServerMetrics bool
@@ -116,6 +204,14 @@ func Main() bool {
 		return httpMux
 	})()
 
+	if cfg.PACFile != "" {
+		pac, err := grpcproxy.NewPACFile(cfg.PACFile, cfg.PACProxy)
+		if err != nil {
+			return false
+		}
+		pac.Register(pcc.MetricsMux)
+	}
+
 	server := &http.Server{
 		Addr: cfg.ClientListen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -125,10 +221,100 @@ func Main() bool {
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
 
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		util.Errorf("net.Listen: %v", err)
+		return false
+	}
+	if cfg.SOCKSAutoDetect {
+		listener = grpcproxy.NewSOCKSDetectListener(listener, pcc)
+	}
+
 	util.Infof("proxy-over-grpc client listening address %s", server.Addr)
+
+	beforeShutdown := func() {}
+	if cfg.ClientSOCKSListen != "" {
+		socksListener, err := net.Listen("tcp", cfg.ClientSOCKSListen)
+		if err != nil {
+			util.Errorf("net.Listen: %v", err)
+			return false
+		}
+		go grpcproxy.ServeSOCKSListener(socksListener, pcc)
+		beforeShutdown = func() {
+			socksListener.Close()
+		}
+
+		util.Infof("SOCKS listening address %s", cfg.ClientSOCKSListen)
+	}
+
+	forwardRules, err := grpcproxy.ParseForwardRules(cfg.Forward)
+	if err != nil {
+		util.Error(err)
+		return false
+	}
+	for _, rule := range forwardRules {
+		forwardListener, err := net.Listen("tcp", rule.Listen)
+		if err != nil {
+			util.Errorf("net.Listen: %v", err)
+			return false
+		}
+		go grpcproxy.ServeForward(forwardListener, pcc, rule)
+
+		closePrev := beforeShutdown
+		beforeShutdown = func() {
+			closePrev()
+			forwardListener.Close()
+		}
+
+		util.Infof("forwarding %s to %s", rule.Listen, rule.Target)
+	}
+
+	if cfg.TransparentListen != "" {
+		transparentCfg := grpcproxy.TransparentConfig{
+			Mode:         cfg.TransparentMode,
+			SniffTimeout: cfg.TransparentSniffTimeout,
+		}
+		transparentListener, err := grpcproxy.ListenTransparent(cfg.TransparentListen, transparentCfg)
+		if err != nil {
+			util.Errorf("transparent listener: %v", err)
+			return false
+		}
+		go grpcproxy.ServeTransparent(transparentListener, pcc, transparentCfg)
+
+		closePrev := beforeShutdown
+		beforeShutdown = func() {
+			closePrev()
+			transparentListener.Close()
+		}
+
+		util.Infof("transparent (%s) listening address %s", cfg.TransparentMode, cfg.TransparentListen)
+	}
+
 	util.Infof("PID: %v", os.Getpid())
 
-	return util.ListenAndServe(server, func() {})
+	return util.Serve(server, listener, beforeShutdown)
+}
+
+// runCommand runs a command instead of the proxy:
+//   - connect host:port: pipes stdin and stdout through a tunnel to host:port,
+//     e.g. ssh -o ProxyCommand='client connect %h:%p'
+func runCommand(args []string, pcc *grpcproxy.ProxyClientContext) bool {
+	switch args[0] {
+	case "connect":
+		if len(args) != 2 {
+			util.Error("usage: client connect host:port")
+			return false
+		}
+
+		if err := grpcproxy.ConnectStdio(pcc, args[1], os.Stdin, os.Stdout); err != nil {
+			util.Errorf("connect %s: %v", args[1], err)
+			return false
+		}
+		return true
+	}
+
+	util.Errorf("unknown command %q, usage: client [connect host:port]", args[0])
+	return false
 }
 
 var metricsMuxErrCnt = util.MakeCounterVecFunc(
@@ -158,7 +344,9 @@ func clientServerMetrics(w http.ResponseWriter, r *http.Request, metricsCtx metr
 		schema = "http"
 	}
 
-	u := fmt.Sprintf("%s://%s/metrics", schema, cfg.ServerAddr)
+	// the first one of several servers
+	serverAddr, _, _ := strings.Cut(cfg.ServerAddr, ",")
+	u := fmt.Sprintf("%s://%s/metrics", schema, serverAddr)
 
 	resp, err := http.Get(u)
 	if err != nil {
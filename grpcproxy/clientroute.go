@@ -0,0 +1,356 @@
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ClientRouter decides how the client reaches a destination (client side):
+//   - rules are "direct <rule>", "pog <rule>" or "reject <rule>" (ACL rule syntax:
+//     domain glob, CIDR, ports), the first matching rule wins
+//   - NO_PROXY-style items ("example.com" with subdomains, ".example.com",
+//     "10.0.0.0/8", "host:port", "*") are direct rules checked after them
+//   - destinations matching no rule go via pog
+//   - destinations are resolved by the client for CIDR rules only
+//
+// UDP associations always go via pog
+type ClientRouter struct {
+	rules    []clientRouteRule
+	needsIPs bool
+}
+
+const (
+	RouteDirect = "direct"
+	RoutePOG    = "pog"
+	RouteReject = "reject"
+)
+
+type clientRouteRule struct {
+	rule   ACLRule
+	action string
+}
+
+// NewClientRouter returns nil if there are no rules
+func NewClientRouter(rules []string, noProxy []string) (*ClientRouter, error) {
+	cr := &ClientRouter{}
+
+	for _, s := range rules {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		action, ruleText, _ := strings.Cut(s, " ")
+		switch action {
+		case RouteDirect, RoutePOG, RouteReject:
+		default:
+			err := fmt.Errorf("route rule %q: must start with direct, pog or reject", s)
+			util.Error(err)
+			return nil, err
+		}
+
+		rule, err := ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			util.Error(err)
+			return nil, err
+		}
+		cr.add(rule, action)
+	}
+
+	for _, s := range noProxy {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		rules, err := parseNoProxyItem(s)
+		if err != nil {
+			util.Error(err)
+			return nil, err
+		}
+		for _, rule := range rules {
+			cr.add(rule, RouteDirect)
+		}
+	}
+
+	if len(cr.rules) == 0 {
+		return nil, nil
+	}
+	return cr, nil
+}
+
+func (cr *ClientRouter) add(rule ACLRule, action string) {
+	cr.rules = append(cr.rules, clientRouteRule{rule, action})
+	if rule.cidr != nil {
+		cr.needsIPs = true
+	}
+}
+
+// parseNoProxyItem converts a NO_PROXY item to ACL rules: a domain
+// matches its subdomains too, with or without the leading dot
+func parseNoProxyItem(s string) ([]ACLRule, error) {
+	host, port := s, ""
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		host, port = h, p
+	}
+	host = strings.TrimPrefix(host, "*")
+	host = strings.TrimPrefix(host, ".")
+
+	withPort := func(host string) string {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" {
+			return host + ":" + port
+		}
+		return host
+	}
+
+	var texts []string
+	switch {
+	case host == "":
+		texts = []string{withPort("*")}
+	case strings.Contains(host, "/"):
+		texts = []string{withPort(host)}
+	case net.ParseIP(host) != nil:
+		bits := 32
+		if net.ParseIP(host).To4() == nil {
+			bits = 128
+		}
+		texts = []string{withPort(host + "/" + strconv.Itoa(bits))}
+	default:
+		texts = []string{withPort(host), withPort("*." + host)}
+	}
+
+	var rules []ACLRule
+	for _, text := range texts {
+		rule, err := ParseACLRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("NO_PROXY item %q: %v", s, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Route returns the action for hostPort, the rule text and the resolved IPs
+// if CIDR rules needed them
+func (cr *ClientRouter) Route(ctx context.Context, hostPort string) (action string, ruleText string, ips []net.IP) {
+	if cr == nil {
+		return RoutePOG, "", nil
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return RoutePOG, "", nil
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ips = ruleIPs(ctx, host, nil, cr.needsIPs)
+	for _, r := range cr.rules {
+		if r.rule.Match(host, ips, port) {
+			return r.action, r.rule.Text, ips
+		}
+	}
+	return RoutePOG, "", ips
+}
+
+// ruleIPs returns the addresses of host to match ACL rules against: ips if
+// resolved already, the host itself if an IP, resolved ones if needsIPs (CIDR rules)
+func ruleIPs(ctx context.Context, host string, ips []net.IP, needsIPs bool) []net.IP {
+	if ips != nil {
+		return ips
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if !needsIPs {
+		return nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		util.Debugf("route: failed to resolve %s: %v", host, err)
+	}
+	return ips
+}
+
+// dialDirect connects to hostPort bypassing pog, via ips if resolved already
+func dialDirect(ctx context.Context, hostPort string, ips []net.IP) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: destDialTimeout}
+	_, port, _ := net.SplitHostPort(hostPort)
+
+	if len(ips) == 0 {
+		return dialer.DialContext(ctx, "tcp", hostPort)
+	}
+
+	var err error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// tunnelRoute is how a tunnel goes, for the access log
+type tunnelRoute struct {
+	action string // RouteDirect, RoutePOG, RouteReject or RouteFallback
+	server string // the pog server name if ServerRouter is set, see ServerRouter.Route()
+}
+
+// chooseRoute applies ClientRouter, FallbackPolicy and ServerRouter to hostPort
+func (pcc *ProxyClientContext) chooseRoute(ctx context.Context, hostPort string) (route tunnelRoute, ruleText string, ips []net.IP, fallback string, server *NextHop) {
+	route.action, ruleText, ips = pcc.Router.Route(ctx, hostPort)
+	fallback = pcc.Fallback.Mode(ctx, hostPort, ips)
+
+	// the kill switch
+	if route.action == RouteDirect && fallback == FallbackStrict {
+		route.action = RoutePOG
+	}
+
+	if route.action == RoutePOG && pcc.Servers != nil {
+		server = pcc.Servers.Route(ctx, hostPort, ips)
+		route.server = serverName(server)
+	}
+	return route, ruleText, ips, fallback, server
+}
+
+// openRoutedTunnel is openTunnel() which also tells the route taken
+func openRoutedTunnel(ctx context.Context, pcc *ProxyClientContext, hostPort string) (ClientStream, tunnelRoute, error) {
+	route, ruleText, ips, fallback, server := pcc.chooseRoute(ctx, hostPort)
+
+	switch route.action {
+	case RouteReject:
+		return nil, route, &ConnectError{HTTPError: &pb.HTTPError{
+			StatusCode: http.StatusForbidden,
+			Error:      fmt.Sprintf("%s is rejected by route rule %q", hostPort, ruleText),
+		}}
+	case RouteDirect:
+		stream, err := openDirectTunnel(ctx, hostPort, ips)
+		return stream, route, err
+	}
+
+	via := pcc
+	if server != nil {
+		via = server.pcc
+		// named servers go with their own auth unless user_auth, see POGAuthMap
+		if !server.UserAuth {
+			ctx = withPOGAuth(ctx, "")
+		}
+	}
+	stream, err := openTunnelViaPOG(ctx, via, hostPort)
+	if pcc.Servers != nil {
+		countServerTunnel(route.server, err)
+	}
+	if err == nil || fallback == "" || !isPOGUnavailable(err) {
+		return stream, route, err
+	}
+
+	if fallback == FallbackStrict {
+		countFallback(fallback, err)
+		return nil, route, err
+	}
+
+	util.Infof("pog server is unavailable for %s, falling back to direct: %v", hostPort, err)
+	stream, err = openDirectTunnel(ctx, hostPort, ips)
+	countFallback(fallback, err)
+	return stream, tunnelRoute{action: RouteFallback}, err
+}
+
+// openDirectTunnel connects to hostPort bypassing pog
+func openDirectTunnel(ctx context.Context, hostPort string, ips []net.IP) (ClientStream, error) {
+	conn, err := dialDirect(ctx, hostPort, ips)
+	if err != nil {
+		return nil, &ConnectError{HTTPError: &pb.HTTPError{
+			StatusCode: http.StatusBadGateway,
+			Error:      err.Error(),
+		}, Err: err}
+	}
+	// the stream is over with ctx, like a gRPC one
+	context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	return newDirectStream(conn), nil
+}
+
+// routeLabel is the route for the access log, empty without ClientRouter and FallbackPolicy
+func (pcc *ProxyClientContext) routeLabel(route tunnelRoute) string {
+	if pcc.Router == nil && pcc.Fallback == nil {
+		return ""
+	}
+	return route.action
+}
+
+// directStream is a ClientStream over a direct connection, so that direct
+// tunnels are served the same way as pog ones
+type directStream struct {
+	conn net.Conn
+	buf  []byte
+
+	eof bool
+}
+
+func newDirectStream(conn net.Conn) *directStream {
+	return &directStream{conn: conn, buf: make([]byte, 32*1024)}
+}
+
+func (ds *directStream) Send(packet *pb.Packet) error {
+	switch u := packet.Union.(type) {
+	case *pb.Packet_Payload:
+		_, err := ds.conn.Write(u.Payload)
+		return directStreamError(err)
+	case *pb.Packet_EndOfStream:
+		return directStreamError(closeWrite(ds.conn))
+	}
+	return fmt.Errorf("direct connection: unexpected packet %+v", packet.Union)
+}
+
+func (ds *directStream) Recv() (*pb.Packet, error) {
+	if ds.eof {
+		return nil, io.EOF
+	}
+
+	n, err := ds.conn.Read(ds.buf)
+	if n > 0 {
+		return &pb.Packet{
+			Union: &pb.Packet_Payload{
+				Payload: append([]byte(nil), ds.buf[:n]...),
+			},
+		}, nil
+	}
+	if err == io.EOF {
+		ds.eof = true
+		return newEndOfStreamPacket(), nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return nil, directStreamError(err)
+}
+
+// directStreamError makes the connection closed by the tunnel teardown
+// look like a cancelled gRPC stream, see isEndError()
+func directStreamError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return err
+}
+
+func (ds *directStream) CloseSend() error {
+	return ds.conn.Close()
+}
@@ -0,0 +1,118 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+// newUnavailablePOGContext returns a client context of a pog server which is down
+func newUnavailablePOGContext(t *testing.T) *ProxyClientContext {
+	l := grpctest.NewLocalListener()
+	l.Close()
+	conn, err := grpctest.DialInsecure(l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	pcc, err := NewProxyClientContext(pb.NewHTTPProxyClient(conn))
+	require.NoError(t, err)
+	return pcc
+}
+
+func TestClientRouter(t *testing.T) {
+	// no pog server at all, so only direct connections succeed
+	pcc := newUnavailablePOGContext(t)
+	var err error
+	pcc.Router, err = NewClientRouter([]string{"reject *.blocked.test", "pog 127.0.0.2/32"}, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	echoAddr := startEchoServer(t)
+	conn2 := dialCONNECT(t, proxyURL, echoAddr)
+	requireEcho(t, conn2)
+	conn2.Close()
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, proxy.Direct)
+	require.NoError(t, err)
+	socksConn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	requireEcho(t, socksConn)
+	socksConn.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer backend.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// plain HTTP forwarding logs the route its connection took
+	httpConn, err := dialTunnelConn(pcc, backend.Listener.Addr().String(), "-", "")
+	require.NoError(t, err)
+	require.Equal(t, RouteDirect, connRoute(httpConn).action)
+	httpConn.Close()
+
+	_, err = dialTunnelConn(pcc, "www.blocked.test:80", "-", "")
+	var routedErr *routedError
+	require.ErrorAs(t, err, &routedErr)
+	require.Equal(t, RouteReject, routedErr.route.action)
+	require.Equal(t, http.StatusForbidden, forwardingErrorCode(err))
+
+	conn, code := connectStatus(t, proxyURL, "www.blocked.test:443")
+	conn.Close()
+	require.Equal(t, http.StatusForbidden, code)
+	// pog rules go first
+	conn, code = connectStatus(t, proxyURL, "127.0.0.2:443")
+	conn.Close()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestClientRouterRules(t *testing.T) {
+	router, err := NewClientRouter(nil, []string{""})
+	require.NoError(t, err)
+	require.Nil(t, router)
+
+	_, err = NewClientRouter([]string{"bypass *"}, nil)
+	require.Error(t, err)
+
+	router, err = NewClientRouter(
+		[]string{"pog api.example.com"},
+		[]string{"example.com", ".example.org", "*.example.net", "10.0.0.0/8", "192.168.1.1", "intranet:8080", "[::1]:22"},
+	)
+	require.NoError(t, err)
+
+	for hostPort, expected := range map[string]string{
+		"example.com:443":     RouteDirect,
+		"www.example.com:443": RouteDirect,
+		"api.example.com:443": RoutePOG,
+		"example.org:443":     RouteDirect,
+		"a.b.example.org:80":  RouteDirect,
+		"example.net:80":      RouteDirect,
+		"notexample.com:443":  RoutePOG,
+		"10.1.2.3:22":         RouteDirect,
+		"192.168.1.1:22":      RouteDirect,
+		"192.168.1.2:22":      RoutePOG,
+		"intranet:8080":       RouteDirect,
+		"intranet:80":         RoutePOG,
+		"[::1]:22":            RouteDirect,
+		"[::1]:23":            RoutePOG,
+	} {
+		action, _, _ := router.Route(context.Background(), hostPort)
+		require.Equal(t, expected, action, hostPort)
+	}
+
+	router, err = NewClientRouter(nil, []string{"*"})
+	require.NoError(t, err)
+	action, _, _ := router.Route(context.Background(), "example.com:443")
+	require.Equal(t, RouteDirect, action)
+}
@@ -0,0 +1,223 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ClientConn is what gRPC clients of a pog server are built on,
+// *grpc.ClientConn or *ConnPool
+type ClientConn interface {
+	grpc.ClientConnInterface
+	io.Closer
+}
+
+// ConnPool spreads streams to a pog server over several gRPC connections
+// (client side), so HTTP/2 MAX_CONCURRENT_STREAMS and head-of-line blocking
+// of a single connection do not throttle all tunnels together:
+//   - a new stream goes to the connection with the least active streams
+//   - if every connection has StreamsPerConn active streams or more, a new
+//     connection is dialed, up to MaxSize ones
+//
+// Mux tunnels (see EnableMux()) share a single stream, so they keep to a single
+// connection of the pool whatever its size; only Run streams are spread
+type ConnPool struct {
+	addr string
+	cfg  ConnPoolConfig
+	dial func(addr string) (*grpc.ClientConn, error)
+
+	mu    sync.Mutex
+	conns []*poolConn
+
+	ctx    context.Context // cancelled by Close()
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type ConnPoolConfig struct {
+	Size           int // connections dialed at once
+	MaxSize        int // connections the pool may grow to, Size if less than Size
+	StreamsPerConn int // active streams per connection to grow the pool at
+}
+
+type poolConn struct {
+	name   string
+	conn   *grpc.ClientConn
+	active atomic.Int64
+}
+
+var (
+	connActiveStreams = util.NewGaugeVecMetric(
+		"grpc_conn_active_streams",
+		"Number of active gRPC streams (including unary calls) per connection to pog server",
+		[]string{"name"},
+	)
+
+	connState = util.NewGaugeVecMetric(
+		"grpc_conn_state",
+		"Connectivity state of gRPC connection to pog server: 1 for the current state, 0 for others",
+		[]string{"name", "state"},
+	)
+)
+
+var connStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// NewConnPool dials cfg.Size connections to addr with dial
+func NewConnPool(addr string, cfg ConnPoolConfig, dial func(addr string) (*grpc.ClientConn, error)) (*ConnPool, error) {
+	cfg.Size = max(cfg.Size, 1)
+	cfg.MaxSize = max(cfg.MaxSize, cfg.Size)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &ConnPool{
+		addr:   addr,
+		cfg:    cfg,
+		dial:   dial,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for len(pool.conns) < cfg.Size {
+		if err := pool.addConnLocked(); err != nil {
+			pool.closeLocked()
+			return nil, err
+		}
+	}
+
+	return pool, nil
+}
+
+func (pool *ConnPool) addConnLocked() error {
+	conn, err := pool.dial(pool.addr)
+	if err != nil {
+		return err
+	}
+
+	pc := &poolConn{
+		name: fmt.Sprintf("%s#%d", pool.addr, len(pool.conns)),
+		conn: conn,
+	}
+	pool.conns = append(pool.conns, pc)
+	connActiveStreams.WithLabelValues(pc.name).Set(0)
+
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+		pc.watchState(pool.ctx)
+	}()
+
+	return nil
+}
+
+func (pc *poolConn) setState(state connectivity.State) {
+	for _, s := range connStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		connState.WithLabelValues(pc.name, s.String()).Set(v)
+	}
+}
+
+func (pc *poolConn) watchState(ctx context.Context) {
+	for {
+		state := pc.conn.GetState()
+		pc.setState(state)
+		if state == connectivity.Shutdown {
+			return
+		}
+
+		if !pc.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// pick chooses the least loaded connection, growing the pool if all are busy
+func (pool *ConnPool) pick() *poolConn {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var best *poolConn
+	for _, pc := range pool.conns {
+		if best == nil || pc.active.Load() < best.active.Load() {
+			best = pc
+		}
+	}
+
+	busy := pool.cfg.StreamsPerConn > 0 && best.active.Load() >= int64(pool.cfg.StreamsPerConn)
+	if busy && len(pool.conns) < pool.cfg.MaxSize && pool.ctx.Err() == nil {
+		if err := pool.addConnLocked(); err != nil {
+			util.Error(err)
+		} else {
+			best = pool.conns[len(pool.conns)-1]
+			util.Infof("grpc connection pool of %s grows to %d", pool.addr, len(pool.conns))
+		}
+	}
+
+	pc := best
+	connActiveStreams.WithLabelValues(pc.name).Set(float64(pc.active.Add(1)))
+	return pc
+}
+
+func (pc *poolConn) done() {
+	connActiveStreams.WithLabelValues(pc.name).Set(float64(pc.active.Add(-1)))
+}
+
+func (pool *ConnPool) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	pc := pool.pick()
+	defer pc.done()
+
+	return pc.conn.Invoke(ctx, method, args, reply, opts...)
+}
+
+func (pool *ConnPool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	pc := pool.pick()
+
+	stream, err := pc.conn.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		pc.done()
+		return nil, err
+	}
+
+	// the stream context is done when the stream is over, either way
+	context.AfterFunc(stream.Context(), pc.done)
+	return stream, nil
+}
+
+func (pool *ConnPool) closeLocked() {
+	pool.cancel()
+	for _, pc := range pool.conns {
+		pc.conn.Close()
+	}
+}
+
+func (pool *ConnPool) Close() error {
+	pool.mu.Lock()
+	pool.closeLocked()
+	conns := pool.conns
+	pool.mu.Unlock()
+
+	pool.wg.Wait()
+	for _, pc := range conns {
+		connActiveStreams.DeleteLabelValues(pc.name)
+		for _, s := range connStates {
+			connState.DeleteLabelValues(pc.name, s.String())
+		}
+	}
+	return nil
+}
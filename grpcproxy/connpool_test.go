@@ -0,0 +1,98 @@
+package grpcproxy
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestConnPool(t *testing.T) {
+	// keeps tunnels open till the client closes them
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	server := grpc.NewServer()
+	RegisterProxySvc(server, makeTestServerConfig(t))
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	defer sc.Close()
+
+	pool, err := NewConnPool(sc.Addr.String(), ConnPoolConfig{Size: 1, MaxSize: 2, StreamsPerConn: 1}, grpctest.DialInsecure)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	pcc, err := NewProxyClientContext(pb.NewHTTPProxyClient(pool))
+	require.NoError(t, err)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	active := func() []int64 {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		var lst []int64
+		for _, pc := range pool.conns {
+			lst = append(lst, pc.active.Load())
+		}
+		return lst
+	}
+
+	conn1 := dialCONNECT(t, proxyURL, l.Addr().String())
+	defer conn1.Close()
+	require.Equal(t, []int64{1}, active())
+
+	// the only connection is busy => grow
+	conn2 := dialCONNECT(t, proxyURL, l.Addr().String())
+	defer conn2.Close()
+	require.Equal(t, []int64{1, 1}, active())
+
+	// no more growth, the least loaded one is taken
+	conn1.Close()
+	require.Eventually(t, func() bool {
+		return active()[0] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	conn3 := dialCONNECT(t, proxyURL, l.Addr().String())
+	defer conn3.Close()
+	require.Equal(t, []int64{1, 1}, active())
+
+	conn4 := dialCONNECT(t, proxyURL, l.Addr().String())
+	defer conn4.Close()
+	require.Len(t, active(), 2)
+
+	// Mux tunnels share a single stream, hence a single connection
+	total := func() (n int64) {
+		for _, a := range active() {
+			n += a
+		}
+		return n
+	}
+	before := total()
+
+	muxPCC, err := NewProxyClientContext(pb.NewHTTPProxyClient(pool))
+	require.NoError(t, err)
+	muxPCC.EnableMux()
+	muxURL := startLocalPOGClient(t, muxPCC)
+	for range [3]struct{}{} {
+		conn := dialCONNECT(t, muxURL, l.Addr().String())
+		defer conn.Close()
+	}
+	require.Equal(t, before+1, total())
+}
@@ -0,0 +1,203 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsUpstream sends a DNS query and returns the response; ctx has a deadline
+type dnsUpstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// parseDNSUpstream understands
+// - "1.1.1.1", "udp://1.1.1.1:53": plain DNS over UDP, TCP is used for truncated responses
+// - "tcp://1.1.1.1": plain DNS over TCP
+// - "tls://1.1.1.1", "tls://dns.google:853": DNS-over-TLS
+// - "https://cloudflare-dns.com/dns-query": DNS-over-HTTPS
+func parseDNSUpstream(s string) (dnsUpstream, error) {
+	scheme, addr, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, addr = "udp", s
+	}
+
+	switch scheme {
+	case "udp", "tcp":
+		return &plainDNSUpstream{
+			addr:    withDefaultPort(addr, "53"),
+			tcpOnly: scheme == "tcp",
+		}, nil
+	case "tls":
+		addr = withDefaultPort(addr, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &dotUpstream{
+			addr:   addr,
+			config: &tls.Config{ServerName: host},
+		}, nil
+	case "https":
+		return &dohUpstream{
+			url:    s,
+			client: &http.Client{},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown scheme of DNS upstream %q", s)
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+func setConnDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+}
+
+// exchangeStream is DNS over a stream: messages are prefixed with 2-byte length
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	defer conn.Close()
+	setConnDeadline(ctx, conn)
+
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+type plainDNSUpstream struct {
+	addr    string
+	tcpOnly bool
+}
+
+func (u *plainDNSUpstream) String() string {
+	if u.tcpOnly {
+		return "tcp://" + u.addr
+	}
+	return "udp://" + u.addr
+}
+
+func (u *plainDNSUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if !u.tcpOnly {
+		resp, err := u.exchangeUDP(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		var p dnsmessage.Parser
+		if hdr, err := p.Start(resp); err != nil || !hdr.Truncated {
+			return resp, nil
+		}
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	return exchangeStream(ctx, conn, query)
+}
+
+func (u *plainDNSUpstream) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	// :TRICKY: the socket is connected, so datagrams from other addresses
+	// than the queried server never reach us
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	setConnDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// skip stray datagrams, the ID is the first 2 bytes
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+type dotUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *dotUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := tls.Dialer{Config: u.config}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	return exchangeStream(ctx, conn, query)
+}
+
+// dohUpstream is RFC 8484 with POST requests
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+const dnsMessageContentType = "application/dns-message"
+
+func (u *dohUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxDatagramSize))
+}
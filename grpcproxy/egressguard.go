@@ -0,0 +1,241 @@
+package grpcproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EgressGuard protects from SSRF: it is checked against resolved IPs (right
+// before dialing them, so DNS rebinding does not help) and rejects loopback,
+// private, link-local (incl. cloud metadata 169.254.169.254) and other special
+// ranges, unless the IP is in the allowlist; the server' own listen address
+// is rejected always, to avoid loops
+type EgressGuard struct {
+	Allowed []*net.IPNet
+
+	// the server' own listen port, 0 if unknown
+	SelfPort int
+	selfIPs  []net.IP
+}
+
+type blockedRange struct {
+	name string
+	net  *net.IPNet
+}
+
+var blockedRanges = func() []blockedRange {
+	var lst []blockedRange
+	for _, item := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"unspecified", []string{"0.0.0.0/8", "::/128"}},
+		{"loopback", []string{"127.0.0.0/8", "::1/128"}},
+		{"private", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}},
+		{"shared", []string{"100.64.0.0/10"}},
+		{"link-local", []string{"169.254.0.0/16", "fe80::/10"}},
+		{"multicast", []string{"224.0.0.0/4", "ff00::/8"}},
+		{"reserved", []string{"192.0.0.0/24", "240.0.0.0/4"}},
+		{"benchmarking", []string{"198.18.0.0/15"}},
+	} {
+		for _, cidr := range item.cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				panic(err)
+			}
+			lst = append(lst, blockedRange{item.name, ipNet})
+		}
+	}
+	return lst
+}()
+
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	var lst []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		// a single IP is /32 (/128)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("bad IP %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			lst = append(lst, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		lst = append(lst, ipNet)
+	}
+
+	return lst, nil
+}
+
+// NewEgressGuard makes a guard with allowlist of comma-separated CIDRs/IPs
+func NewEgressGuard(allowlist string, selfPort int) (*EgressGuard, error) {
+	allowed, err := parseCIDRList(allowlist)
+	if err != nil {
+		err = fmt.Errorf("failed to parse egress allowlist: %v", err)
+		util.Error(err)
+		return nil, err
+	}
+
+	guard := &EgressGuard{
+		Allowed:  allowed,
+		SelfPort: selfPort,
+	}
+
+	if selfPort != 0 {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			util.Errorf("net.InterfaceAddrs: %v", err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				guard.selfIPs = append(guard.selfIPs, ipNet.IP)
+			}
+		}
+	}
+
+	return guard, nil
+}
+
+// reason returns why ip:port is rejected, "" if it is not;
+// nil guard allows everything
+func (g *EgressGuard) reason(ip net.IP, port int) string {
+	if g == nil {
+		return ""
+	}
+
+	if g.SelfPort != 0 && port == g.SelfPort {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return "self"
+		}
+		for _, selfIP := range g.selfIPs {
+			if selfIP.Equal(ip) {
+				return "self"
+			}
+		}
+	}
+
+	for _, ipNet := range g.Allowed {
+		if ipNet.Contains(ip) {
+			return ""
+		}
+	}
+
+	// IPv4-mapped ::ffff:a.b.c.d addresses match IPv4 ranges as is
+	for _, br := range blockedRanges {
+		if br.net.Contains(ip) {
+			return br.name
+		}
+	}
+
+	// NAT64, 6to4 and Teredo addresses lead to IPv4 ones
+	for _, ip4 := range embeddedIPv4s(ip) {
+		if reason := g.reason(ip4, port); reason != "" {
+			return reason
+		}
+	}
+
+	return ""
+}
+
+var (
+	nat64Prefix   = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+	nat64LocalUse = &net.IPNet{IP: net.ParseIP("64:ff9b:1::"), Mask: net.CIDRMask(48, 128)}
+	sixToFour     = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+	teredoPrefix  = &net.IPNet{IP: net.ParseIP("2001::"), Mask: net.CIDRMask(32, 128)}
+)
+
+// embeddedIPv4s returns the IPv4 addresses of NAT64 (64:ff9b::/96, 64:ff9b:1::/48),
+// 6to4 (2002::/16) or Teredo (2001::/32) one, nil for others
+func embeddedIPv4s(ip net.IP) []net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+
+	switch {
+	case nat64Prefix.Contains(ip):
+		return []net.IP{ip[12:16]}
+	case nat64LocalUse.Contains(ip):
+		return localNAT64IPv4s(ip)
+	case sixToFour.Contains(ip):
+		return []net.IP{ip[2:6]}
+	case teredoPrefix.Contains(ip):
+		// the Teredo server and the client' obfuscated address (RFC 4380, 4)
+		client := make(net.IP, net.IPv4len)
+		for i := range client {
+			client[i] = ^ip[12+i]
+		}
+		return []net.IP{ip[4:8], client}
+	}
+	return nil
+}
+
+// localNAT64IPv4s returns the IPv4 addresses ip may embed: the local-use prefix
+// is /48, /56, /64 or /96 long (RFC 6052, 2.2) and we do not know which, so every
+// layout with zero bits 64-71 ("u") and zero suffix is taken
+func localNAT64IPv4s(ip net.IP) []net.IP {
+	zero := func(b []byte) bool {
+		for _, c := range b {
+			if c != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	var lst []net.IP
+	if ip[8] == 0 {
+		if zero(ip[11:16]) {
+			lst = append(lst, net.IP{ip[6], ip[7], ip[9], ip[10]})
+		}
+		if zero(ip[12:16]) {
+			lst = append(lst, net.IP{ip[7], ip[9], ip[10], ip[11]})
+		}
+		if zero(ip[13:16]) {
+			lst = append(lst, net.IP{ip[9], ip[10], ip[11], ip[12]})
+		}
+	}
+	// 0.0.0.0 of /96 is rather a shorter prefix' address
+	if !zero(ip[12:16]) || len(lst) == 0 {
+		lst = append(lst, ip[12:16])
+	}
+	return lst
+}
+
+// Check rejects if any of ips is not allowed
+func (g *EgressGuard) Check(host string, ips []net.IP, port int) error {
+	for _, ip := range ips {
+		if reason := g.reason(ip, port); reason != "" {
+			util.Infof("egress guard: connecting to %s (%s) is denied: %s address", host, ip, reason)
+			egressGuardDeniedCnt(reason, 1)
+
+			return status.Errorf(codes.PermissionDenied, "connecting to %s (%s) is forbidden: %s address", host, ip, reason)
+		}
+	}
+
+	return nil
+}
+
+var egressGuardDeniedCnt = util.MakeCounterVecFunc(
+	"egress_guard_denied_total",
+	"Number of connections denied by the egress guard, by address kind",
+)
@@ -0,0 +1,104 @@
+package grpcproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressGuardReason(t *testing.T) {
+	guard, err := NewEgressGuard("10.1.0.0/16, 192.168.1.1", 8080)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		ip     string
+		port   int
+		reason string
+	}{
+		{"8.8.8.8", 443, ""},
+		{"2a00:1450:4001:82b::200e", 443, ""},
+		{"127.0.0.1", 80, "loopback"},
+		{"::1", 80, "loopback"},
+		{"::ffff:127.0.0.1", 80, "loopback"},
+		{"0.0.0.0", 80, "unspecified"},
+		{"10.2.0.1", 80, "private"},
+		{"10.1.2.3", 80, ""},
+		{"192.168.1.1", 80, ""},
+		{"192.168.1.2", 80, "private"},
+		{"169.254.169.254", 80, "link-local"},
+		{"fd00:ec2::254", 80, "private"},
+		{"100.100.100.200", 80, "shared"},
+		{"127.0.0.1", 8080, "self"},
+		// IPv4 special ranges
+		{"192.0.0.170", 80, "reserved"},
+		{"198.19.1.1", 80, "benchmarking"},
+		{"240.0.0.1", 80, "reserved"},
+		// IPv4-mapped
+		{"::ffff:10.2.0.1", 80, "private"},
+		{"::ffff:8.8.8.8", 443, ""},
+		// NAT64
+		{"64:ff9b::10.2.0.1", 80, "private"},
+		{"64:ff9b::169.254.169.254", 80, "link-local"},
+		{"64:ff9b::10.1.2.3", 80, ""},
+		{"64:ff9b::8.8.8.8", 443, ""},
+		// NAT64 local-use, the prefix of any length
+		{"64:ff9b:1::10.2.0.1", 80, "private"},
+		{"64:ff9b:1:a9fe:a9:fe00::", 80, "link-local"},
+		{"64:ff9b:1:0:7f:0:100:0", 80, "loopback"},
+		{"64:ff9b:1::8.8.8.8", 443, ""},
+		{"64:ff9b:1:808:8:800::", 443, ""},
+		// 6to4
+		{"2002:7f00:1::", 80, "loopback"},
+		{"2002:a9fe:a9fe::1", 80, "link-local"},
+		{"2002:808:808::", 443, ""},
+		// Teredo: server 65.54.227.120, client 127.0.0.1 obfuscated
+		{"2001:0:4136:e378:8000:63bf:80ff:fffe", 80, "loopback"},
+		{"2001:0:4136:e378:8000:63bf:f7f7:f7f7", 443, ""},
+		{"2001:0:a02:1:8000:63bf:f7f7:f7f7", 443, "private"},
+	} {
+		require.Equal(t, tc.reason, guard.reason(net.ParseIP(tc.ip), tc.port), tc)
+	}
+
+	_, err = NewEgressGuard("10.0.0.0/33", 0)
+	require.Error(t, err)
+}
+
+func TestEgressGuardDial(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, port, err := splitHostPort(echoAddr)
+	require.NoError(t, err)
+
+	check := func(guard *EgressGuard, code int) {
+		cfg := makeTestServerConfig(t)
+		cfg.EgressGuard = guard
+		proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		}
+
+		// DNS name resolving to loopback is no better
+		for _, host := range []string{echoAddr, net.JoinHostPort("localhost", strconv.Itoa(port))} {
+			resp, err := client.Get("http://" + host)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, code, resp.StatusCode, host)
+		}
+	}
+
+	guard, err := NewEgressGuard("", 0)
+	require.NoError(t, err)
+	check(guard, http.StatusForbidden)
+
+	guard, err = NewEgressGuard("127.0.0.0/8,::1", 0)
+	require.NoError(t, err)
+	// the echo server is not HTTP, so 502 means it is connected
+	check(guard, http.StatusBadGateway)
+
+	guard, err = NewEgressGuard("127.0.0.0/8,::1", port)
+	require.NoError(t, err)
+	check(guard, http.StatusForbidden)
+}
@@ -0,0 +1,248 @@
+package grpcproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// Egress source is the local address tunnels to destinations leave from:
+// - a source is a local IP ("203.0.113.5") or an interface name ("eth1"),
+//   an interface gives its address of the destination' family
+// - several sources make a pool, tunnels take them round-robin
+// - an account may have rules to choose the pool by destination, then
+//   its own pool, then the global EGRESS_SOURCE one
+
+type egressSource struct {
+	ip    net.IP
+	iface string
+}
+
+func parseEgressSource(s string) (egressSource, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return egressSource{ip: ip}, nil
+	}
+
+	if _, err := net.InterfaceByName(s); err != nil {
+		return egressSource{}, fmt.Errorf("egress source %q is neither IP nor interface: %v", s, err)
+	}
+	return egressSource{iface: s}, nil
+}
+
+func (src egressSource) String() string {
+	if src.iface != "" {
+		return src.iface
+	}
+	return src.ip.String()
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// localIP is the source address to reach dst from
+func (src egressSource) localIP(dst net.IP) (net.IP, error) {
+	if src.iface == "" {
+		if !sameFamily(src.ip, dst) {
+			return nil, fmt.Errorf("egress source %s cannot reach %s", src.ip, dst)
+		}
+		return src.ip, nil
+	}
+
+	iface, err := net.InterfaceByName(src.iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !sameFamily(ipNet.IP, dst) {
+			continue
+		}
+		// link-local addresses need a zone, so they are no good
+		if ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return ipNet.IP, nil
+	}
+
+	return nil, fmt.Errorf("egress interface %s has no address to reach %s", src.iface, dst)
+}
+
+// udpLocalAddrs are the addresses to bind UDP association sockets to, per
+// destination' family; nil if the source has no address of the family
+func (src *egressSource) udpLocalAddrs() (v4, v6 *net.UDPAddr, err error) {
+	if src == nil {
+		return nil, nil, nil
+	}
+
+	ip4, err4 := src.localIP(net.IPv4zero)
+	ip6, err6 := src.localIP(net.IPv6zero)
+	if err4 != nil && err6 != nil {
+		return nil, nil, err4
+	}
+
+	if err4 == nil {
+		v4 = &net.UDPAddr{IP: ip4}
+	}
+	if err6 == nil {
+		v6 = &net.UDPAddr{IP: ip6}
+	}
+	return v4, v6, nil
+}
+
+type egressSourcePool struct {
+	sources []egressSource
+	next    atomic.Uint32
+}
+
+func newEgressSourcePool(lst []string) (*egressSourcePool, error) {
+	pool := &egressSourcePool{}
+	for _, s := range lst {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		src, err := parseEgressSource(s)
+		if err != nil {
+			return nil, err
+		}
+		pool.sources = append(pool.sources, src)
+	}
+
+	if len(pool.sources) == 0 {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// pick takes the next source, nil pool gives nil source (the system' choice)
+func (pool *egressSourcePool) pick() *egressSource {
+	if pool == nil {
+		return nil
+	}
+
+	i := pool.next.Add(1) - 1
+	return &pool.sources[int(i)%len(pool.sources)]
+}
+
+type egressSourceRule struct {
+	rule ACLRule
+	pool *egressSourcePool
+}
+
+// EgressSourceRule is how a rule looks in AuthItem.EgressSourceRules
+type EgressSourceRule struct {
+	Match  string   `json:"match"` // ACL rule syntax, see ParseACLRule()
+	Source []string `json:"source"`
+}
+
+type accountEgressSource struct {
+	rules []egressSourceRule
+	pool  *egressSourcePool
+}
+
+// EgressSourcePolicy picks egress sources for tunnels
+type EgressSourcePolicy struct {
+	global   *egressSourcePool
+	accounts map[string]accountEgressSource
+}
+
+// NewEgressSourcePolicy makes the policy out of global sources (EGRESS_SOURCE) and
+// AuthItem.EgressSource/EgressSourceRules; nil if there are no sources at all
+func NewEgressSourcePolicy(global []string, authLst []AuthItem) (*EgressSourcePolicy, error) {
+	p := &EgressSourcePolicy{
+		accounts: map[string]accountEgressSource{},
+	}
+
+	var err error
+	p.global, err = newEgressSourcePool(global)
+	if err != nil {
+		util.Error(err)
+		return nil, err
+	}
+
+	for _, ai := range authLst {
+		var aes accountEgressSource
+
+		aes.pool, err = newEgressSourcePool(ai.EgressSource)
+		if err == nil {
+			for _, r := range ai.EgressSourceRules {
+				var esr egressSourceRule
+				esr.rule, err = ParseACLRule(r.Match)
+				if err != nil {
+					break
+				}
+				esr.pool, err = newEgressSourcePool(r.Source)
+				if err != nil {
+					break
+				}
+				aes.rules = append(aes.rules, esr)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to parse egress source of %v auth item: %v", ai.Name, err)
+			util.Error(err)
+			return nil, err
+		}
+
+		if aes.pool != nil || len(aes.rules) > 0 {
+			p.accounts[ai.Name] = aes
+		}
+	}
+
+	if p.global == nil && len(p.accounts) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// HasSources tells if tunnels of user may get a source, so destinations are to be resolved
+func (p *EgressSourcePolicy) HasSources(user string) bool {
+	if p == nil {
+		return false
+	}
+
+	_, ok := p.accounts[user]
+	return ok || p.global != nil
+}
+
+// PickDefault chooses the source regardless of the destination (the account'
+// pool or the global one), for UDP associations
+func (p *EgressSourcePolicy) PickDefault(user string) *egressSource {
+	if p == nil {
+		return nil
+	}
+
+	if aes, ok := p.accounts[user]; ok && aes.pool != nil {
+		return aes.pool.pick()
+	}
+	return p.global.pick()
+}
+
+// Pick chooses the source for the destination, nil means the system' choice
+func (p *EgressSourcePolicy) Pick(user string, host string, ips []net.IP, port int) *egressSource {
+	if p == nil {
+		return nil
+	}
+
+	if aes, ok := p.accounts[user]; ok {
+		for _, r := range aes.rules {
+			if r.rule.Match(host, ips, port) {
+				return r.pool.pick()
+			}
+		}
+		if aes.pool != nil {
+			return aes.pool.pick()
+		}
+	}
+
+	return p.global.pick()
+}
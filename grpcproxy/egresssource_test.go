@@ -0,0 +1,116 @@
+package grpcproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressSourceInterface(t *testing.T) {
+	src, err := parseEgressSource("lo")
+	if err != nil {
+		t.Skip("no lo interface")
+	}
+
+	ip, err := src.localIP(net.ParseIP("127.0.0.1"))
+	require.NoError(t, err)
+	require.True(t, ip.IsLoopback())
+
+	_, err = parseEgressSource("no-such-interface0")
+	require.Error(t, err)
+
+	_, err = (&egressSource{ip: net.ParseIP("127.0.0.1")}).localIP(net.ParseIP("::1"))
+	require.Error(t, err)
+}
+
+func TestEgressSourceUDP(t *testing.T) {
+	src, err := parseEgressSource("lo")
+	if err != nil {
+		t.Skip("no lo interface")
+	}
+
+	// an interface gives a socket per family
+	conns, err := listenUDP(&src)
+	require.NoError(t, err)
+	defer conns.Close()
+	require.NotNil(t, conns.forDst(net.ParseIP("127.0.0.1")))
+	if conns.v6 != nil {
+		require.NotSame(t, conns.v4, conns.forDst(net.ParseIP("::1")))
+	}
+
+	// an IPv4 source cannot reach IPv6 destinations
+	conns4, err := listenUDP(&egressSource{ip: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conns4.Close()
+	require.Nil(t, conns4.forDst(net.ParseIP("::1")))
+
+	// the system' choice is a dual-stack socket
+	dual, err := listenUDP(nil)
+	require.NoError(t, err)
+	defer dual.Close()
+	require.Same(t, dual.forDst(net.ParseIP("127.0.0.1")), dual.forDst(net.ParseIP("::1")))
+}
+
+func TestEgressSourceDial(t *testing.T) {
+	// tells the peer its address once asked, so that the answer does not
+	// race with the CONNECT response
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Read(make([]byte, 1))
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			fmt.Fprint(conn, host)
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().String()
+
+	var err error
+	cfg := makeTestServerConfig(t)
+	cfg.EgressSource, err = NewEgressSourcePolicy(nil, []AuthItem{{
+		Name:         "anonymous",
+		EgressSource: []string{"127.0.0.2", "127.0.0.3"},
+		EgressSourceRules: []EgressSourceRule{
+			{Match: "*:1", Source: []string{"127.0.0.4"}},
+		},
+	}})
+	require.NoError(t, err)
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+	remoteHost := func() string {
+		conn := dialCONNECT(t, proxyURL, addr)
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("?"))
+		require.NoError(t, err)
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	// the pool is round-robin, the rule does not match
+	require.Equal(t, "127.0.0.2", remoteHost())
+	require.Equal(t, "127.0.0.3", remoteHost())
+	require.Equal(t, "127.0.0.2", remoteHost())
+
+	src := cfg.EgressSource.Pick("anonymous", "example.com", nil, 1)
+	require.Equal(t, "127.0.0.4", src.String())
+	require.Nil(t, cfg.EgressSource.Pick("other", "example.com", nil, 1))
+
+	_, err = NewEgressSourcePolicy([]string{"not-an-ip-or-interface0"}, nil)
+	require.Error(t, err)
+
+	policy, err := NewEgressSourcePolicy([]string{""}, nil)
+	require.NoError(t, err)
+	require.Nil(t, policy)
+}
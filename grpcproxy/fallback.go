@@ -0,0 +1,131 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FallbackPolicy decides what the client does if the pog server is unavailable (client side):
+//   - "direct" mode dials the destination directly instead of answering 503
+//   - "strict" mode (kill switch) never dials directly, not even for ClientRouter'
+//     direct rules, those go via pog instead
+//   - rules "direct <rule>" or "strict <rule>" (ACL rule syntax) override the mode
+//     per destination, the first matching rule wins
+//
+// Without a policy the client answers 503, as before
+type FallbackPolicy struct {
+	mode     string
+	rules    []fallbackRule
+	needsIPs bool
+}
+
+const (
+	FallbackDirect = "direct"
+	FallbackStrict = "strict"
+)
+
+// RouteFallback is the route of tunnels dialed directly because pog is unavailable
+const RouteFallback = "fallback"
+
+type fallbackRule struct {
+	rule ACLRule
+	mode string
+}
+
+var fallbackConnections = util.NewCounterVecMetric(
+	"fallback_connections_total",
+	"Number of tunnels the pog server was unavailable for, by fallback mode and HTTP-like status code",
+	[]string{"mode", "code"},
+)
+
+func countFallback(mode string, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = tunnelErrorCode(err)
+	}
+	fallbackConnections.WithLabelValues(mode, strconv.Itoa(code)).Inc()
+}
+
+// NewFallbackPolicy returns nil if there are neither mode nor rules
+func NewFallbackPolicy(mode string, rules []string) (*FallbackPolicy, error) {
+	checkMode := func(mode string) error {
+		switch mode {
+		case FallbackDirect, FallbackStrict:
+			return nil
+		}
+		return fmt.Errorf("fallback mode %q: must be direct or strict", mode)
+	}
+
+	fp := &FallbackPolicy{mode: mode}
+	if mode != "" {
+		if err := checkMode(mode); err != nil {
+			util.Error(err)
+			return nil, err
+		}
+	}
+
+	for _, s := range rules {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		mode, ruleText, _ := strings.Cut(s, " ")
+		if err := checkMode(mode); err != nil {
+			err = fmt.Errorf("fallback rule %q: %v", s, err)
+			util.Error(err)
+			return nil, err
+		}
+
+		rule, err := ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			util.Error(err)
+			return nil, err
+		}
+		fp.rules = append(fp.rules, fallbackRule{rule, mode})
+		if rule.cidr != nil {
+			fp.needsIPs = true
+		}
+	}
+
+	if fp.mode == "" && len(fp.rules) == 0 {
+		return nil, nil
+	}
+	return fp, nil
+}
+
+// Mode returns the fallback mode for hostPort, empty if none; ips are the
+// destination' addresses if resolved already
+func (fp *FallbackPolicy) Mode(ctx context.Context, hostPort string, ips []net.IP) string {
+	if fp == nil {
+		return ""
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fp.mode
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ips = ruleIPs(ctx, host, ips, fp.needsIPs)
+	for _, r := range fp.rules {
+		if r.rule.Match(host, ips, port) {
+			return r.mode
+		}
+	}
+	return fp.mode
+}
+
+// isPOGUnavailable tells if openTunnelViaPOG() failed because of the pog server
+// rather than the destination
+func isPOGUnavailable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
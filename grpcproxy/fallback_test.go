@@ -0,0 +1,70 @@
+package grpcproxy
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func fallbackCount(mode, code string) float64 {
+	metric := dto.Metric{}
+	fallbackConnections.WithLabelValues(mode, code).Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestFallbackDirect(t *testing.T) {
+	pcc := newUnavailablePOGContext(t)
+	var err error
+	pcc.Fallback, err = NewFallbackPolicy(FallbackDirect, []string{"strict 127.0.0.2/32"})
+	require.NoError(t, err)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	echoAddr := startEchoServer(t)
+	before := fallbackCount(FallbackDirect, "200")
+	conn := dialCONNECT(t, proxyURL, echoAddr)
+	requireEcho(t, conn)
+	conn.Close()
+	require.Equal(t, before+1, fallbackCount(FallbackDirect, "200"))
+
+	// per-destination override
+	before = fallbackCount(FallbackStrict, "503")
+	conn2, code := connectStatus(t, proxyURL, "127.0.0.2:443")
+	conn2.Close()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, before+1, fallbackCount(FallbackStrict, "503"))
+}
+
+func TestFallbackKillSwitch(t *testing.T) {
+	pcc := newUnavailablePOGContext(t)
+	var err error
+	pcc.Router, err = NewClientRouter(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	pcc.Fallback, err = NewFallbackPolicy(FallbackStrict, nil)
+	require.NoError(t, err)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	// direct rules go via pog too
+	conn, code := connectStatus(t, proxyURL, startEchoServer(t))
+	conn.Close()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestFallbackPolicyParsing(t *testing.T) {
+	fp, err := NewFallbackPolicy("", []string{" "})
+	require.NoError(t, err)
+	require.Nil(t, fp)
+	require.Equal(t, "", fp.Mode(context.Background(), "example.com:443", nil))
+
+	_, err = NewFallbackPolicy("always", nil)
+	require.Error(t, err)
+	_, err = NewFallbackPolicy("", []string{"maybe *"})
+	require.Error(t, err)
+
+	fp, err = NewFallbackPolicy("", []string{"direct *.example.com:443", "strict *"})
+	require.NoError(t, err)
+	require.Equal(t, FallbackDirect, fp.Mode(context.Background(), "www.example.com:443", nil))
+	require.Equal(t, FallbackStrict, fp.Mode(context.Background(), "www.example.com:80", nil))
+}
@@ -0,0 +1,104 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// ForwardRule is a static port forwarding (ssh -L style, client side): every
+// connection accepted on Listen is tunneled to Target, so software which is
+// not proxy-aware can use pog
+type ForwardRule struct {
+	Listen string // [host]:port, host is localhost if missing
+	Target string // host:port
+}
+
+// ParseForwardRules parses a comma-separated list of listen=target items,
+// listen is a port or host:port, e.g. "15432=db.internal:5432,0.0.0.0:8443=example.com:443"
+func ParseForwardRules(s string) ([]ForwardRule, error) {
+	var lst []ForwardRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		listen, target, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("forwarding rule %q: listen=target expected", item)
+		}
+		if _, err := strconv.Atoi(listen); err == nil {
+			listen = net.JoinHostPort("localhost", listen)
+		}
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return nil, fmt.Errorf("forwarding rule %q: %v", item, err)
+		}
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("forwarding rule %q: %v", item, err)
+		}
+
+		lst = append(lst, ForwardRule{Listen: listen, Target: target})
+	}
+	return lst, nil
+}
+
+// name is the metrics label of the rule
+func (rule ForwardRule) name() string {
+	return rule.Listen + "=" + rule.Target
+}
+
+var forwardConnections = util.NewCounterVecMetric(
+	"forward_connections_total",
+	"Number of connections of port forwarding rules, by rule and HTTP-like status code",
+	[]string{"name", "code"},
+)
+
+// ServeForward tunnels connections accepted on l to rule.Target, till l is closed
+func ServeForward(l net.Listener, pcc *ProxyClientContext, rule ForwardRule) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go handleForward(conn, pcc, rule)
+	}
+}
+
+func handleForward(conn net.Conn, pcc *ProxyClientContext, rule ForwardRule) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var route tunnelRoute
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: rule.Target,
+			User:        "-",
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Code:        strconv.Itoa(code),
+			Proto:       "FORWARD",
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
+		})
+		forwardConnections.WithLabelValues(rule.name(), strconv.Itoa(code)).Inc()
+	}
+
+	stream, route, err := openRoutedTunnel(ctx, pcc, rule.Target)
+	if err != nil {
+		util.Errorf("forwarding %s: %v", rule.name(), err)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+	logReq(http.StatusOK)
+
+	handleBinaryTunneling(stream, conn, cancel, pcc.RateLimits.clientTunnelLimits(""))
+}
@@ -0,0 +1,57 @@
+package grpcproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForward(t *testing.T) {
+	addr := startWhoAmIServer(t)
+	_, pcc := startLocalPOG(t)
+
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	rule := ForwardRule{Listen: l.Addr().String(), Target: addr}
+	go ServeForward(l, pcc, rule)
+
+	forwarded := func() float64 {
+		metric := dto.Metric{}
+		forwardConnections.WithLabelValues(rule.name(), "200").Write(&metric)
+		return metric.GetCounter().GetValue()
+	}
+	before := forwarded()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("?"))
+	require.NoError(t, err)
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", string(b))
+
+	require.Eventually(t, func() bool {
+		return forwarded() == before+1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestParseForwardRules(t *testing.T) {
+	lst, err := ParseForwardRules("15432=db.internal:5432, 0.0.0.0:8443=example.com:443")
+	require.NoError(t, err)
+	require.Equal(t, []ForwardRule{
+		{Listen: "localhost:15432", Target: "db.internal:5432"},
+		{Listen: "0.0.0.0:8443", Target: "example.com:443"},
+	}, lst)
+
+	_, err = ParseForwardRules("15432=db.internal")
+	require.Error(t, err)
+	_, err = ParseForwardRules("15432")
+	require.Error(t, err)
+}
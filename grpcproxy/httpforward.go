@@ -0,0 +1,243 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// tunnelAddr is a net.Addr for a tunnel' destination
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "pog" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// streamConn represents a tunnel stream as net.Conn so that
+// http.Transport can use it as an ordinary connection
+type streamConn struct {
+	io.Reader
+	io.Writer
+
+	stream   ClientStream
+	cancel   context.CancelFunc
+	hostPort string
+	route    tunnelRoute // how the tunnel went, see dialTunnelConn()
+
+	closeOnce sync.Once
+	done      chan struct{} // wakes rate limit waits on Close()
+}
+
+func newStreamConn(stream ClientStream, cancel context.CancelFunc, hostPort string) *streamConn {
+	return &streamConn{
+		Reader:   NewStreamReader(stream),
+		Writer:   NewStreamWriter(stream),
+		stream:   stream,
+		cancel:   cancel,
+		hostPort: hostPort,
+		done:     make(chan struct{}),
+	}
+}
+
+// limit applies limits of a client tunnel: writes go up, reads come down
+func (c *streamConn) limit(limits tunnelLimits) {
+	c.Writer = newRateLimitedWriter(c.Writer, limits.FromConn, c.done)
+	c.Reader = limits.wrapReader(c.Reader, limits.ToConn, c.done)
+}
+
+func (c *streamConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		closeSend(c.stream)
+		// unblocks pending Recv() too
+		c.cancel()
+	})
+	return nil
+}
+
+// CloseWrite half-closes the tunnel, see handleBinaryTunneling()
+func (c *streamConn) CloseWrite() error {
+	return Send(c.stream, newEndOfStreamPacket())
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return tunnelAddr("-") }
+func (c *streamConn) RemoteAddr() net.Addr { return tunnelAddr(c.hostPort) }
+
+// deadlines are not supported by gRPC streams, http.Transport does not
+// require them anyway
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dialTunnelConn opens a tunnel of user with pogAuth credentials, CLIENT_POG_AUTH if empty
+func dialTunnelConn(pcc *ProxyClientContext, hostPort string, user, pogAuth string) (net.Conn, error) {
+	// :TRICKY: the connection outlives the request it was dialed for
+	// (keep-alive), so it gets its own context
+	ctx, cancel := context.WithCancel(context.Background())
+	if pogAuth != "" {
+		ctx = withPOGAuth(ctx, pogAuth)
+	}
+
+	stream, route, err := openRoutedTunnel(ctx, pcc, hostPort)
+	if err != nil {
+		cancel()
+		return nil, &routedError{err, route}
+	}
+
+	conn := newStreamConn(stream, cancel, hostPort)
+	conn.route = route
+	conn.limit(pcc.RateLimits.clientTunnelLimits(user))
+	return conn, nil
+}
+
+// routedError is an error of dialTunnelConn() with the route it took
+type routedError struct {
+	error
+	route tunnelRoute
+}
+
+func (e *routedError) Unwrap() error {
+	return e.error
+}
+
+// connRoute tells the route of a connection dialed by dialTunnelConn()
+func connRoute(conn net.Conn) tunnelRoute {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if sc, ok := conn.(*streamConn); ok {
+		return sc.route
+	}
+	return tunnelRoute{}
+}
+
+func newTunnelTransport(pcc *ProxyClientContext, user, pogAuth string) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTunnelConn(pcc, addr, user, pogAuth)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// userTransport is the keep-alive transport of a user
+type userTransport struct {
+	transport *http.Transport
+	pogAuth   string
+}
+
+// tunnelTransport returns the keep-alive transport of user, so that connections
+// of one user (with own rate limits and pog credentials) are not reused for
+// another; a transport of the user' previous credentials is replaced
+func (pcc *ProxyClientContext) tunnelTransport(user, pogAuth string) *http.Transport {
+	pcc.userTransportsMu.Lock()
+	defer pcc.userTransportsMu.Unlock()
+
+	ut, ok := pcc.userTransports[user]
+	if ok && ut.pogAuth == pogAuth {
+		return ut.transport
+	}
+	if ok {
+		// connections in use are closed once their requests are over
+		ut.transport.CloseIdleConnections()
+	}
+
+	if pcc.userTransports == nil {
+		pcc.userTransports = map[string]userTransport{}
+	}
+	ut = userTransport{newTunnelTransport(pcc, user, pogAuth), pogAuth}
+	pcc.userTransports[user] = ut
+	return ut.transport
+}
+
+// forwardingErrorCode tells tunnel failures from bad responses of the destination
+func forwardingErrorCode(err error) int {
+	var connectErr *ConnectError
+	if _, ok := status.FromError(err); ok || errors.As(err, &connectErr) {
+		return tunnelErrorCode(err)
+	}
+
+	return http.StatusBadGateway
+}
+
+// handleHTTP proxies absolute-form requests like "GET http://example.com/ HTTP/1.1"
+// through pog server; WebSocket (Upgrade) requests are supported too
+func handleHTTP(w http.ResponseWriter, r *http.Request, pcc *ProxyClientContext) {
+	user := "-"
+	var route tunnelRoute
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: r.Host,
+			User:        user,
+			RemoteAddr:  r.RemoteAddr,
+			Code:        strconv.Itoa(code),
+			Proto:       "HTTP",
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
+		})
+	}
+
+	httpErrorAndLog := func(w http.ResponseWriter, errMsg string, code int) {
+		httpError(w, errMsg, code)
+		logReq(code)
+	}
+
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		httpErrorAndLog(w, "unsupported scheme: "+r.URL.Scheme, http.StatusBadRequest)
+		return
+	}
+
+	user, userPass, err := checkProxyAuth(r, pcc.AuthLst)
+	if err != nil {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="CLIENT_AUTH_* list"`)
+		httpErrorAndLog(w, err.Error(), http.StatusProxyAuthRequired)
+		return
+	}
+
+	// a request (or an upgraded connection) takes a tunnel like CONNECT does
+	release, err := pcc.TunnelCaps.Acquire(user, "")
+	if err != nil {
+		httpErrorAndLog(w, status.Convert(err).Message(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	// the route is of the connection the request goes by, a new or a keep-alive one
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			route = connRoute(info.Conn)
+		},
+	}))
+
+	rp := &httputil.ReverseProxy{
+		// Rewrite (not Director) to drop X-Forwarded-* headers: the request URL
+		// is absolute so it needs no rewriting; hop-by-hop headers like
+		// Proxy-Authorization and Connection are stripped by ReverseProxy itself
+		Rewrite:   func(pr *httputil.ProxyRequest) {},
+		Transport: pcc.tunnelTransport(user, pcc.POGAuth.credentials(user, userPass)),
+		ModifyResponse: func(resp *http.Response) error {
+			logReq(resp.StatusCode)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var routedErr *routedError
+			if errors.As(err, &routedErr) {
+				route = routedErr.route
+			}
+			httpErrorAndLog(w, err.Error(), forwardingErrorCode(err))
+		},
+	}
+
+	rp.ServeHTTP(w, r)
+}
@@ -0,0 +1,522 @@
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Mux stream carries many logical streams, each one behaves like a Run stream:
+// - a logical stream is opened by the client with a Packet frame of a new stream_id
+// - payload is flow controlled per logical stream: the sender has a window of
+//   muxInitialWindow bytes which is replenished with window_update frames
+//   when the receiver consumes the payload; so a slow tunnel never blocks
+//   other ones
+// - Close frame is CloseSend() (or handler return, at server side) for the logical stream
+// - old servers answer Unimplemented for Mux, and clients fall back to Run streams
+
+const (
+	muxVersion       = 1
+	muxInitialWindow = 256 * 1024
+)
+
+var errMuxUnsupported = errors.New("pog server does not support Mux")
+
+type muxTransport interface {
+	Send(*pb.MuxFrame) error
+	Recv() (*pb.MuxFrame, error)
+	Context() context.Context
+}
+
+type muxSession struct {
+	transport muxTransport
+	sendMu    sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	lastID  uint32
+
+	done chan struct{}
+	err  error // why the session is over, valid after done is closed
+}
+
+func newMuxSession(transport muxTransport) *muxSession {
+	return &muxSession{
+		transport: transport,
+		streams:   map[uint32]*muxStream{},
+		done:      make(chan struct{}),
+	}
+}
+
+func (ms *muxSession) sendFrame(frame *pb.MuxFrame) error {
+	ms.sendMu.Lock()
+	defer ms.sendMu.Unlock()
+
+	select {
+	case <-ms.done:
+		return ms.err
+	default:
+	}
+
+	if err := ms.transport.Send(frame); err != nil {
+		if !isEndError(err) {
+			util.Errorf("mux stream.Send(%v) failed: %v", frame, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// serve reads frames until the transport is over; onOpen is invoked for
+// every logical stream the peer opens and must not block, nil onOpen means
+// the peer may not open streams
+func (ms *muxSession) serve(onOpen func(*muxStream)) error {
+	err := ms.readLoop(onOpen)
+
+	ms.mu.Lock()
+	ms.err = err
+	close(ms.done)
+	ms.mu.Unlock()
+
+	return err
+}
+
+func isMuxOpenPacket(frame *pb.MuxFrame) bool {
+	switch frame.GetPacket().GetUnion().(type) {
+	case *pb.Packet_ConnectRequest, *pb.Packet_UdpAssociateRequest, *pb.Packet_ReverseAcceptRequest:
+		return true
+	}
+	return false
+}
+
+func (ms *muxSession) readLoop(onOpen func(*muxStream)) error {
+	for {
+		frame, err := ms.transport.Recv()
+		if err != nil {
+			if !isEndError(err) {
+				util.Errorf("mux stream.Recv() failed: %v", err)
+			}
+			return err
+		}
+
+		opened := false
+		ms.mu.Lock()
+		s, ok := ms.streams[frame.StreamId]
+		if !ok && onOpen != nil && frame.StreamId > ms.lastID && isMuxOpenPacket(frame) {
+			ms.lastID = frame.StreamId
+			s = ms.newStreamLocked(frame.StreamId, ms.transport.Context())
+			ok, opened = true, true
+		}
+		ms.mu.Unlock()
+
+		if !ok {
+			// a late frame of a finished stream
+			continue
+		}
+
+		switch u := frame.Union.(type) {
+		case *pb.MuxFrame_Packet:
+			s.push(u.Packet)
+		case *pb.MuxFrame_Close:
+			s.remoteClose(u.Close)
+		case *pb.MuxFrame_WindowUpdate:
+			s.addWindow(int(u.WindowUpdate))
+		}
+
+		if opened {
+			onOpen(s)
+		}
+	}
+}
+
+// open starts a new logical stream (client side)
+func (ms *muxSession) open(ctx context.Context) (*muxStream, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	select {
+	case <-ms.done:
+		return nil, ms.err
+	default:
+	}
+
+	ms.lastID++
+	return ms.newStreamLocked(ms.lastID, ctx), nil
+}
+
+func (ms *muxSession) newStreamLocked(id uint32, parentCtx context.Context) *muxStream {
+	ctx, cancel := context.WithCancel(parentCtx)
+	s := &muxStream{
+		id:          id,
+		session:     ms,
+		ctx:         ctx,
+		cancel:      cancel,
+		sendWindow:  muxInitialWindow,
+		recvReady:   make(chan struct{}, 1),
+		windowReady: make(chan struct{}, 1),
+	}
+	// the same as for a canceled Run stream: the peer gets Canceled
+	s.stopWatch = context.AfterFunc(ctx, func() {
+		s.closeLocal(status.FromContextError(ctx.Err()))
+		ms.remove(s)
+	})
+
+	ms.streams[id] = s
+	return s
+}
+
+func (ms *muxSession) remove(s *muxStream) {
+	ms.mu.Lock()
+	delete(ms.streams, s.id)
+	ms.mu.Unlock()
+
+	s.stopWatch()
+	s.cancel()
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// muxStream is a logical stream, it implements ClientStream
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopWatch func() bool
+
+	mu           sync.Mutex
+	queue        []*pb.Packet
+	queued       int // payload bytes in queue, up to muxInitialWindow
+	recvErr      error
+	sendWindow   int
+	localClosed  bool
+	remoteClosed bool
+
+	recvReady   chan struct{}
+	windowReady chan struct{}
+}
+
+func (s *muxStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *muxStream) ctxErr() error {
+	return status.FromContextError(s.ctx.Err()).Err()
+}
+
+func (s *muxStream) push(packet *pb.Packet) {
+	s.mu.Lock()
+	if s.remoteClosed {
+		s.mu.Unlock()
+		return
+	}
+	if p, ok := packet.Union.(*pb.Packet_Payload); ok {
+		s.queued += len(p.Payload)
+	}
+	if s.queued > muxInitialWindow {
+		s.resetLocked()
+		return
+	}
+	s.queue = append(s.queue, packet)
+	s.mu.Unlock()
+
+	notify(s.recvReady)
+}
+
+// resetLocked drops the stream of a peer which ignores the window, so
+// the queue does not grow without bound; it unlocks s.mu
+func (s *muxStream) resetLocked() {
+	st := status.New(codes.ResourceExhausted, "mux flow control window exceeded")
+	util.Errorf("mux stream %d: %s", s.id, st.Message())
+
+	// the rest of the peer' frames are ignored
+	s.remoteClosed = true
+	s.queue = nil
+	s.queued = 0
+	s.recvErr = st.Err()
+	s.mu.Unlock()
+
+	notify(s.recvReady)
+	s.closeLocal(st)
+	s.session.remove(s)
+}
+
+func (s *muxStream) addWindow(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+
+	notify(s.windowReady)
+}
+
+func (s *muxStream) remoteClose(c *pb.MuxClose) {
+	s.mu.Lock()
+	s.remoteClosed = true
+	s.recvErr = io.EOF
+	if code := codes.Code(c.Code); code != codes.OK {
+		s.recvErr = status.Error(code, c.Message)
+	}
+	localClosed := s.localClosed
+	s.mu.Unlock()
+
+	notify(s.recvReady)
+	if localClosed {
+		s.session.remove(s)
+	}
+}
+
+// closeLocal sends Close frame once, st == nil means OK
+func (s *muxStream) closeLocal(st *status.Status) error {
+	s.mu.Lock()
+	if s.localClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	remoteClosed := s.remoteClosed
+	s.mu.Unlock()
+
+	// wake up a sender waiting for window
+	notify(s.windowReady)
+
+	err := s.session.sendFrame(&pb.MuxFrame{
+		StreamId: s.id,
+		Union: &pb.MuxFrame_Close{
+			Close: &pb.MuxClose{
+				Code:    int32(st.Code()),
+				Message: st.Message(),
+			},
+		},
+	})
+
+	if remoteClosed {
+		s.session.remove(s)
+	}
+	return err
+}
+
+func (s *muxStream) CloseSend() error {
+	return s.closeLocal(nil)
+}
+
+func (s *muxStream) Recv() (*pb.Packet, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			packet := s.queue[0]
+			s.queue = s.queue[1:]
+			p, ok := packet.Union.(*pb.Packet_Payload)
+			if ok {
+				s.queued -= len(p.Payload)
+			}
+			s.mu.Unlock()
+
+			if ok {
+				s.session.sendFrame(&pb.MuxFrame{
+					StreamId: s.id,
+					Union: &pb.MuxFrame_WindowUpdate{
+						WindowUpdate: uint32(len(p.Payload)),
+					},
+				})
+			}
+			return packet, nil
+		}
+		if err := s.recvErr; err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.recvReady:
+		case <-s.ctx.Done():
+			return nil, s.ctxErr()
+		case <-s.session.done:
+			return nil, s.session.err
+		}
+	}
+}
+
+// acquireWindow waits for the peer to allow sending up to want bytes
+func (s *muxStream) acquireWindow(want int) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.localClosed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		if s.sendWindow > 0 {
+			n := min(want, s.sendWindow)
+			s.sendWindow -= n
+			s.mu.Unlock()
+			return n, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.windowReady:
+		case <-s.ctx.Done():
+			return 0, s.ctxErr()
+		case <-s.session.done:
+			return 0, s.session.err
+		}
+	}
+}
+
+func (s *muxStream) sendPacket(packet *pb.Packet) error {
+	if s.ctx.Err() != nil {
+		return s.ctxErr()
+	}
+
+	return s.session.sendFrame(&pb.MuxFrame{
+		StreamId: s.id,
+		Union: &pb.MuxFrame_Packet{
+			Packet: packet,
+		},
+	})
+}
+
+func (s *muxStream) Send(packet *pb.Packet) error {
+	p, ok := packet.Union.(*pb.Packet_Payload)
+	if !ok {
+		return s.sendPacket(packet)
+	}
+
+	payload := p.Payload
+	for len(payload) > 0 {
+		n, err := s.acquireWindow(len(payload))
+		if err != nil {
+			return err
+		}
+
+		chunk := &pb.Packet{
+			Union: &pb.Packet_Payload{
+				Payload: payload[:n],
+			},
+		}
+		if err := s.sendPacket(chunk); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+
+	return nil
+}
+
+func newMuxHelloFrame() *pb.MuxFrame {
+	return &pb.MuxFrame{
+		Union: &pb.MuxFrame_Hello{
+			Hello: &pb.MuxHello{
+				Version: muxVersion,
+			},
+		},
+	}
+}
+
+func (s *httpProxyServer) Mux(stream pb.HTTPProxy_MuxServer) error {
+	ms := newMuxSession(stream)
+	if err := ms.sendFrame(newMuxHelloFrame()); err != nil {
+		return err
+	}
+
+	// :TRICKY: logical streams send frames, so we wait for them
+	// before returning from the handler
+	var wg sync.WaitGroup
+	err := ms.serve(func(ls *muxStream) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var statusErr error
+			s.doRun(ls, &statusErr)
+
+			ls.closeLocal(status.Convert(statusErr))
+		}()
+	})
+	wg.Wait()
+
+	if isEndError(err) {
+		return nil
+	}
+	return err
+}
+
+// muxClient keeps a Mux session at the client side, reopening it as needed
+type muxClient struct {
+	client pb.HTTPProxyClient
+
+	mu          sync.Mutex
+	session     *muxSession
+	unsupported bool
+}
+
+func (mc *muxClient) newStream(ctx context.Context) (ClientStream, error) {
+	session, err := mc.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return session.open(ctx)
+}
+
+func (mc *muxClient) getSession() (*muxSession, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.unsupported {
+		return nil, errMuxUnsupported
+	}
+
+	if session := mc.session; session != nil {
+		select {
+		case <-session.done:
+		default:
+			return session, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := mc.client.Mux(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the server greets us, so we know it supports Mux
+	frame, err := stream.Recv()
+	if err != nil {
+		cancel()
+		if status.Code(err) == codes.Unimplemented {
+			util.Info("pog server does not support Mux, falling back to Run streams")
+			mc.unsupported = true
+			return nil, errMuxUnsupported
+		}
+		return nil, err
+	}
+	if frame.GetHello() == nil {
+		cancel()
+		return nil, fmt.Errorf("mux: got %v instead of hello", frame)
+	}
+
+	session := newMuxSession(stream)
+	go func() {
+		defer cancel()
+		session.serve(nil)
+	}()
+
+	mc.session = session
+	return session, nil
+}
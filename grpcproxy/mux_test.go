@@ -0,0 +1,161 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/iter"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/grpctest"
+)
+
+func TestMux(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyURL, pcc := startLocalPOG(t)
+	pcc.EnableMux()
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, proxy.Direct)
+	require.NoError(t, err)
+
+	// a stalled tunnel (nobody reads the echo) must not block other ones
+	stalled, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer stalled.Close()
+	go stalled.Write(make([]byte, 4*muxInitialWindow))
+
+	var wg sync.WaitGroup
+	for range iter.N(5) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := dialer.Dial("tcp", echoAddr)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// more than a window, to be flow controlled
+			data := make([]byte, 3*muxInitialWindow+1)
+			rand.Read(data)
+			go conn.Write(data)
+
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(conn, got)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, got))
+		}()
+	}
+	wg.Wait()
+
+	// ConnectResponse errors pass through
+	l := grpctest.NewLocalListener()
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	_, err = dialer.Dial("tcp", closedAddr)
+	require.ErrorContains(t, err, "host unreachable")
+
+	// all the tunnels went via the same Mux stream
+	session, err := pcc.mux.getSession()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, session.lastID)
+}
+
+// runOnlyServer is an old pog server without Mux
+type runOnlyServer struct {
+	pb.UnimplementedHTTPProxyServer
+	s *httpProxyServer
+}
+
+func (ros *runOnlyServer) Run(stream pb.HTTPProxy_RunServer) error {
+	return ros.s.Run(stream)
+}
+
+func TestMuxFallback(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	server := grpc.NewServer()
+	pb.RegisterHTTPProxyServer(server, &runOnlyServer{s: &httpProxyServer{cfg: makeTestServerConfig(t)}})
+
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	defer sc.Close()
+
+	pcc, err := NewProxyClientContext(pb.NewHTTPProxyClient(sc.Conn))
+	require.NoError(t, err)
+	pcc.EnableMux()
+
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go ServeSOCKSListener(l, pcc)
+
+	dialer, err := proxy.SOCKS5("tcp", l.Addr().String(), nil, proxy.Direct)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	requireEcho(t, conn)
+
+	require.True(t, pcc.mux.unsupported)
+}
+
+// chanMuxTransport is the peer' side of a Mux stream
+type chanMuxTransport struct {
+	in  chan *pb.MuxFrame
+	out chan *pb.MuxFrame
+}
+
+func (ct *chanMuxTransport) Send(frame *pb.MuxFrame) error {
+	ct.out <- frame
+	return nil
+}
+
+func (ct *chanMuxTransport) Recv() (*pb.MuxFrame, error) {
+	frame, ok := <-ct.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+func (ct *chanMuxTransport) Context() context.Context {
+	return context.Background()
+}
+
+func TestMuxWindowExceeded(t *testing.T) {
+	ct := &chanMuxTransport{in: make(chan *pb.MuxFrame), out: make(chan *pb.MuxFrame, 10)}
+	ms := newMuxSession(ct)
+	go ms.serve(nil)
+	defer close(ct.in)
+
+	s, err := ms.open(context.Background())
+	require.NoError(t, err)
+
+	// the peer sends more than the window without waiting for updates
+	payload := make([]byte, muxInitialWindow/2+1)
+	for range iter.N(2) {
+		ct.in <- &pb.MuxFrame{
+			StreamId: s.id,
+			Union:    &pb.MuxFrame_Packet{Packet: &pb.Packet{Union: &pb.Packet_Payload{Payload: payload}}},
+		}
+	}
+
+	// the stream is reset, queued payload is dropped
+	frame := <-ct.out
+	require.Equal(t, int32(codes.ResourceExhausted), frame.GetClose().GetCode())
+
+	_, err = s.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
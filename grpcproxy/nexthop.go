@@ -0,0 +1,266 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// NextHop is the next pog server to re-issue ConnectRequest to (multi-hop),
+// like the client does; it is set with POG_NEXT_HOP_* env variables
+type NextHop struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"` // host:port
+
+	Auth string `json:"auth,omitempty"` // user:password at the next hop
+
+	// TLS settings, the same as the client has
+	ServerHost string `json:"server_host,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	SkipVerify bool   `json:"skip_verify,omitempty"`
+
+	Mux bool `json:"mux,omitempty"`
+
+	// end-users go with their own credentials, see POGAuthMap (client' named servers only)
+	UserAuth bool `json:"user_auth,omitempty"`
+
+	conn *grpc.ClientConn
+	pcc  *ProxyClientContext
+}
+
+const NextHopEnvVarPrefix = "POG_NEXT_HOP_"
+
+func ParseNextHops(envVarPrefix string) ([]*NextHop, error) {
+	return parseNamedServers(envVarPrefix, "next hop")
+}
+
+// parseNamedServers parses NextHop JSON of env variables with envVarPrefix,
+// kind names them in errors
+func parseNamedServers(envVarPrefix, kind string) ([]*NextHop, error) {
+	var lst []*NextHop
+	for _, e := range os.Environ() {
+		key, value, ok := strings.Cut(e, "=")
+		if !ok || !strings.HasPrefix(key, envVarPrefix) {
+			continue
+		}
+
+		hop := &NextHop{}
+		if err := json.Unmarshal([]byte(value), hop); err != nil {
+			err = fmt.Errorf("failed to parse %v %s: %v", key, kind, err)
+			util.Error(err)
+			return nil, err
+		}
+		if hop.Name == "" || hop.Addr == "" {
+			err := fmt.Errorf("%v %s: name and addr are required", key, kind)
+			util.Error(err)
+			return nil, err
+		}
+
+		lst = append(lst, hop)
+	}
+
+	return lst, nil
+}
+
+func (hop *NextHop) connect() error {
+	var opts []grpc.DialOption
+	if hop.ServerHost != "" {
+		opts = append(opts, grpc.WithAuthority(hop.ServerHost))
+	}
+	if hop.Insecure {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		cred := credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: hop.SkipVerify,
+		})
+		opts = append(opts, grpc.WithTransportCredentials(cred))
+	}
+	if hop.Auth != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(BasicAuthCredentials{Auth: hop.Auth}))
+	}
+
+	conn, err := grpc.Dial(hop.Addr, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to dial pog server %s (%s): %v", hop.Name, hop.Addr, err)
+	}
+
+	hop.conn = conn
+	hop.pcc = &ProxyClientContext{
+		Client: pb.NewHTTPProxyClient(conn),
+	}
+	if hop.Mux {
+		hop.pcc.EnableMux()
+	}
+	return nil
+}
+
+// dial opens a tunnel to hostPort via the next hop; its ConnectError is
+// propagated to our client as is
+func (hop *NextHop) dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	stream, err := openTunnel(ctx, hop.pcc, hostPort)
+	if err != nil {
+		cancel()
+
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			return nil, hopConnectError{connectErr}
+		}
+		return nil, fmt.Errorf("next hop %s: %w", hop.Name, err)
+	}
+
+	return newStreamConn(stream, cancel, hostPort), nil
+}
+
+// hopConnectError is ConnectError of the next hop with a gRPC code for our status and logs
+type hopConnectError struct {
+	*ConnectError
+}
+
+func (e hopConnectError) Unwrap() error {
+	return e.ConnectError
+}
+
+func (e hopConnectError) GRPCStatus() *status.Status {
+	code := codes.Unavailable
+	switch e.HTTPError.StatusCode {
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	}
+	return status.New(code, e.HTTPError.Error)
+}
+
+type nextHopRule struct {
+	rule ACLRule
+	hop  *NextHop // nil for direct
+}
+
+// NextHopRouter chooses the next hop for a tunnel: AuthItem.NextHop pins
+// the account, otherwise NEXT_HOP_RULES "<hop name> <ACL rule>" or
+// "direct <ACL rule>" are checked, the first matching rule wins; the rest go direct.
+// Destinations are not resolved for the rules, so CIDR rules match IP literals only
+type NextHopRouter struct {
+	hops     map[string]*NextHop
+	accounts map[string]*NextHop
+	rules    []nextHopRule
+}
+
+// NewNextHopRouter connects to hops, it returns nil if there are no hops
+func NewNextHopRouter(hops []*NextHop, rules []string, authLst []AuthItem) (*NextHopRouter, error) {
+	if len(hops) == 0 {
+		return nil, nil
+	}
+
+	router := &NextHopRouter{
+		hops:     map[string]*NextHop{},
+		accounts: map[string]*NextHop{},
+	}
+
+	err := router.init(hops, rules, authLst)
+	if err != nil {
+		util.Error(err)
+		router.Close()
+		return nil, err
+	}
+	return router, nil
+}
+
+func (router *NextHopRouter) init(hops []*NextHop, rules []string, authLst []AuthItem) error {
+	for _, hop := range hops {
+		if _, ok := router.hops[hop.Name]; ok || hop.Name == "direct" {
+			return fmt.Errorf("next hop name %q is duplicated or reserved", hop.Name)
+		}
+		if err := hop.connect(); err != nil {
+			return err
+		}
+		router.hops[hop.Name] = hop
+	}
+
+	for _, s := range rules {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		name, ruleText, _ := strings.Cut(s, " ")
+		var r nextHopRule
+		if name != "direct" {
+			r.hop = router.hops[name]
+			if r.hop == nil {
+				return fmt.Errorf("next hop rule %q: unknown next hop %q", s, name)
+			}
+		}
+
+		var err error
+		r.rule, err = ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			return err
+		}
+		router.rules = append(router.rules, r)
+	}
+
+	for _, ai := range authLst {
+		if ai.NextHop == "" {
+			continue
+		}
+
+		hop := router.hops[ai.NextHop]
+		if hop == nil {
+			return fmt.Errorf("%v auth item: unknown next hop %q", ai.Name, ai.NextHop)
+		}
+		router.accounts[ai.Name] = hop
+	}
+
+	return nil
+}
+
+func (router *NextHopRouter) Close() {
+	if router == nil {
+		return
+	}
+
+	for _, hop := range router.hops {
+		if hop.conn != nil {
+			hop.conn.Close()
+		}
+	}
+}
+
+// Route returns the next hop for the destination, nil for direct connections
+func (router *NextHopRouter) Route(user string, host string, port int) *NextHop {
+	if router == nil {
+		return nil
+	}
+
+	if hop, ok := router.accounts[user]; ok {
+		return hop
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	}
+	for _, r := range router.rules {
+		if r.rule.Match(host, ips, port) {
+			return r.hop
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package grpcproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startExitPOG runs a pog server which requires edge:secret and connects from 127.0.0.2
+func startExitPOG(t *testing.T, acl *ACL) string {
+	hash, err := hashPassword("secret")
+	require.NoError(t, err)
+	ai := &AuthInterceptor{AuthLst: []AuthItem{{Name: "edge", Hash: hash, ExpDate: time.Now().Add(time.Hour)}}}
+
+	cfg := makeTestServerConfig(t)
+	cfg.EgressSource, err = NewEgressSourcePolicy([]string{"127.0.0.2"}, nil)
+	require.NoError(t, err)
+	cfg.ACL = ACLPolicy{aclAnyAccount: acl}
+
+	server := grpc.NewServer(grpc.ChainStreamInterceptor(ai.ProcessStream))
+	RegisterProxySvc(server, cfg)
+
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	t.Cleanup(sc.Close)
+
+	return sc.Addr.String()
+}
+
+func TestNextHop(t *testing.T) {
+	addr := startWhoAmIServer(t)
+
+	deny, err := parseACL(aclJSON{Deny: []string{"*:1"}})
+	require.NoError(t, err)
+	exitAddr := startExitPOG(t, deny)
+
+	startEdge := func(auth string, rules ...string) *url.URL {
+		hop := &NextHop{Name: "exit", Addr: exitAddr, Auth: auth, Insecure: true}
+
+		var err error
+		cfg := makeTestServerConfig(t)
+		cfg.NextHops, err = NewNextHopRouter([]*NextHop{hop}, rules, nil)
+		require.NoError(t, err)
+		t.Cleanup(cfg.NextHops.Close)
+
+		edgeURL, _ := startLocalPOGWithConfig(t, cfg)
+		return edgeURL
+	}
+
+	edgeURL := startEdge("edge:secret", "exit *")
+	require.Equal(t, "127.0.0.2", whoAmI(t, edgeURL, addr))
+
+	// the next hop' errors are propagated
+	conn, code := connectStatus(t, edgeURL, "127.0.0.1:1")
+	conn.Close()
+	require.Equal(t, http.StatusForbidden, code)
+
+	edgeURL = startEdge("edge:wrong", "exit *")
+	conn, code = connectStatus(t, edgeURL, addr)
+	conn.Close()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+
+	edgeURL = startEdge("edge:secret", "direct 127.0.0.1", "exit *")
+	require.Equal(t, "127.0.0.1", whoAmI(t, edgeURL, addr))
+
+	_, err = NewNextHopRouter([]*NextHop{{Name: "exit", Addr: exitAddr}}, []string{"unknown *"}, nil)
+	require.Error(t, err)
+	_, err = NewNextHopRouter([]*NextHop{{Name: "exit", Addr: exitAddr}}, nil, []AuthItem{{Name: "user", NextHop: "unknown"}})
+	require.Error(t, err)
+}
+
+func TestNextHopUDP(t *testing.T) {
+	var err error
+	cfg := makeTestServerConfig(t)
+	hop := &NextHop{Name: "exit", Addr: "127.0.0.1:1", Insecure: true}
+	cfg.NextHops, err = NewNextHopRouter([]*NextHop{hop}, []string{"exit *:53"}, nil)
+	require.NoError(t, err)
+	defer cfg.NextHops.Close()
+	s := &httpProxyServer{cfg: cfg}
+
+	conns, err := listenUDP(nil)
+	require.NoError(t, err)
+	defer conns.Close()
+
+	// destinations of next hops are rejected rather than reached from here
+	_, err = s.resolveUDPDestination(context.Background(), "anonymous", "127.0.0.1:53", conns)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	addr, err := s.resolveUDPDestination(context.Background(), "anonymous", "127.0.0.1:54", conns)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:54", addr.String())
+}
@@ -0,0 +1,168 @@
+package grpcproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// PACFile serves proxy.pac (and wpad.dat) built from the rules file, a rule per line:
+// "proxy <rule>" or "direct <rule>", rule is a domain glob or a CIDR (ACL rule
+// syntax without ports); the first matching rule wins, DIRECT if none.
+// The file is re-read when it changes, so rules are updated without a restart
+type PACFile struct {
+	path  string
+	proxy string // PAC proxy string, e.g. "PROXY pog.lan:18080"; the request' Host if empty
+
+	mu         sync.Mutex
+	modTime    time.Time
+	rules      []pacRule
+	badModTime time.Time // of a broken file reported already
+}
+
+type pacRule struct {
+	rule   ACLRule
+	direct bool
+}
+
+const pacContentType = "application/x-ns-proxy-autoconfig"
+
+func NewPACFile(path, proxy string) (*PACFile, error) {
+	pf := &PACFile{path: path, proxy: proxy}
+	if err := pf.reload(); err != nil {
+		util.Error(err)
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Register serves the PAC file as /proxy.pac and /wpad.dat
+func (pf *PACFile) Register(mux *http.ServeMux) {
+	mux.Handle("/proxy.pac", pf)
+	mux.Handle("/wpad.dat", pf)
+}
+
+func parsePACRules(data string) ([]pacRule, error) {
+	var rules []pacRule
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		action, ruleText, _ := strings.Cut(line, " ")
+		var r pacRule
+		switch action {
+		case "direct":
+			r.direct = true
+		case "proxy":
+		default:
+			return nil, fmt.Errorf("line %d: %q must start with proxy or direct", i+1, line)
+		}
+
+		var err error
+		r.rule, err = ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if len(r.rule.ports) > 0 {
+			return nil, fmt.Errorf("line %d: ports are not supported in PAC rules", i+1)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// reload re-reads the rules file if it has changed; a broken file is
+// reported once per change
+func (pf *PACFile) reload() error {
+	fi, err := os.Stat(pf.path)
+	if err != nil {
+		return err
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if fi.ModTime().Equal(pf.modTime) || fi.ModTime().Equal(pf.badModTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(pf.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parsePACRules(string(data))
+	if err != nil {
+		pf.badModTime = fi.ModTime()
+		return fmt.Errorf("PAC rules %s: %v", pf.path, err)
+	}
+
+	if !pf.modTime.IsZero() {
+		util.Infof("PAC rules %s are reloaded", pf.path)
+	}
+	pf.rules = rules
+	pf.modTime = fi.ModTime()
+	return nil
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func renderPAC(rules []pacRule, proxy string) string {
+	var sb strings.Builder
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	sb.WriteString("\thost = host.toLowerCase();\n")
+
+	for _, r := range rules {
+		result := proxy
+		if r.direct {
+			result = "DIRECT"
+		}
+
+		var cond string
+		switch {
+		case r.rule.cidr == nil:
+			cond = fmt.Sprintf("shExpMatch(host, %s)", jsString(r.rule.domain))
+		case r.rule.cidr.IP.To4() != nil:
+			cond = fmt.Sprintf("isInNet(host, %s, %s)",
+				jsString(r.rule.cidr.IP.String()), jsString(net.IP(r.rule.cidr.Mask).String()))
+		default:
+			// a Microsoft extension for IPv6
+			cond = fmt.Sprintf("typeof isInNetEx == \"function\" && isInNetEx(host, %s)", jsString(r.rule.cidr.String()))
+		}
+
+		fmt.Fprintf(&sb, "\t// %s\n", r.rule.Text)
+		fmt.Fprintf(&sb, "\tif (%s) return %s;\n", cond, jsString(result))
+	}
+
+	sb.WriteString("\treturn \"DIRECT\";\n}\n")
+	return sb.String()
+}
+
+func (pf *PACFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// keep serving the previous rules if the new ones are broken
+	if err := pf.reload(); err != nil {
+		util.Error(err)
+	}
+
+	proxy := pf.proxy
+	if proxy == "" {
+		proxy = "PROXY " + r.Host
+	}
+
+	pf.mu.Lock()
+	body := renderPAC(pf.rules, proxy)
+	pf.mu.Unlock()
+
+	w.Header().Set("Content-Type", pacContentType)
+	fmt.Fprint(w, body)
+}
@@ -0,0 +1,81 @@
+package grpcproxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPACFile(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "pac.rules")
+	writeRules := func(data string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(rulesPath, []byte(data), 0o644))
+		require.NoError(t, os.Chtimes(rulesPath, modTime, modTime))
+	}
+
+	now := time.Now()
+	writeRules(`
+# internal ones
+direct *.corp.example.com
+direct 10.0.0.0/8
+proxy [2001:db8::/32]
+proxy *
+`, now)
+
+	pac, err := NewPACFile(rulesPath, "")
+	require.NoError(t, err)
+
+	_, pcc := startLocalPOG(t)
+	pcc.MetricsMux = http.NewServeMux()
+	pac.Register(pcc.MetricsMux)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	get := func(path string) string {
+		resp, err := http.Get(proxyURL.String() + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, pacContentType, resp.Header.Get("Content-Type"))
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	require.Equal(t, `function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	// *.corp.example.com
+	if (shExpMatch(host, "*.corp.example.com")) return "DIRECT";
+	// 10.0.0.0/8
+	if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";
+	// [2001:db8::/32]
+	if (typeof isInNetEx == "function" && isInNetEx(host, "2001:db8::/32")) return "PROXY `+proxyURL.Host+`";
+	// *
+	if (shExpMatch(host, "*")) return "PROXY `+proxyURL.Host+`";
+	return "DIRECT";
+}
+`, get("/proxy.pac"))
+
+	// reloaded on change
+	writeRules("proxy *.example.com\n", now.Add(time.Second))
+	pac.proxy = "PROXY pog.lan:18080"
+	wpad := get("/wpad.dat")
+	require.Contains(t, wpad, `if (shExpMatch(host, "*.example.com")) return "PROXY pog.lan:18080";`)
+	require.NotContains(t, wpad, "corp")
+
+	// broken rules do not replace the working ones
+	writeRules("tunnel *\n", now.Add(2*time.Second))
+	require.Equal(t, wpad, get("/wpad.dat"))
+	// and are not parsed again till they change
+	require.NoError(t, pac.reload())
+	writeRules("tunnel *\n", now.Add(3*time.Second))
+	require.Error(t, pac.reload())
+
+	_, err = parsePACRules("direct *:443")
+	require.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package grpcproxy
+
+import (
+	"context"
+	"encoding/base64"
+)
+
+// POGAuthMap maps CLIENT_AUTH_* users to their own pog server accounts (client side),
+// so that the server' logs, limits and expiry are per person rather than per client:
+//   - AuthItem.POGAuth "user:password" is the user' account at the server
+//   - with passthrough, the rest of users are authenticated at the server with the
+//     credentials they gave to the client (HTTP Basic or SOCKS5 username/password)
+//   - other tunnels go with CLIENT_POG_AUTH
+//
+// The credentials are sent per Run stream, so such tunnels do not share Mux streams;
+// named servers (CLIENT_POG_SERVER_*) keep their own auth unless NextHop.UserAuth
+type POGAuthMap struct {
+	passthrough bool
+	users       map[string]string
+}
+
+// NewPOGAuthMap returns nil if no user has own credentials
+func NewPOGAuthMap(authLst []AuthItem, passthrough bool) *POGAuthMap {
+	m := &POGAuthMap{
+		passthrough: passthrough,
+		users:       map[string]string{},
+	}
+	for _, ai := range authLst {
+		if ai.POGAuth != "" {
+			m.users[ai.Name] = ai.POGAuth
+		}
+	}
+
+	if !passthrough && len(m.users) == 0 {
+		return nil
+	}
+	return m
+}
+
+// credentials returns the pog server credentials of user, empty for CLIENT_POG_AUTH;
+// userPass is "user:password" the user is authenticated with, if any
+func (m *POGAuthMap) credentials(user, userPass string) string {
+	if m == nil {
+		return ""
+	}
+
+	if auth, ok := m.users[user]; ok {
+		return auth
+	}
+	if m.passthrough {
+		return userPass
+	}
+	return ""
+}
+
+// withUser makes tunnels opened with ctx go with the credentials of user
+func (m *POGAuthMap) withUser(ctx context.Context, user, userPass string) context.Context {
+	auth := m.credentials(user, userPass)
+	if auth == "" {
+		return ctx
+	}
+	return withPOGAuth(ctx, auth)
+}
+
+type pogAuthKey struct{}
+
+// withPOGAuth sets the credentials of Run streams opened with ctx, empty auth
+// is for the connection' own ones
+func withPOGAuth(ctx context.Context, auth string) context.Context {
+	return context.WithValue(ctx, pogAuthKey{}, auth)
+}
+
+func pogAuthFromContext(ctx context.Context) string {
+	auth, _ := ctx.Value(pogAuthKey{}).(string)
+	return auth
+}
+
+// userAuthCredentials are per-RPC credentials of an end-user, they take
+// precedence over BasicAuthCredentials of the connection
+type userAuthCredentials string
+
+func (auth userAuthCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return basicAuthMetadata(string(auth)), nil
+}
+
+func (auth userAuthCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func basicAuthMetadata(auth string) map[string]string {
+	s := base64.StdEncoding.EncodeToString([]byte(auth))
+	return map[string]string{
+		"authorization": "Basic " + s,
+	}
+}
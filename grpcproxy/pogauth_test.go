@@ -0,0 +1,153 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestPOGAuthMap(t *testing.T) {
+	makeAccount := func(name, pass string, egress ...string) AuthItem {
+		hash, err := hashPassword(pass)
+		require.NoError(t, err)
+		return AuthItem{Name: name, Hash: hash, ExpDate: time.Now().Add(time.Hour), EgressSource: egress}
+	}
+
+	// server accounts are told by the address tunnels leave from
+	serverAccounts := []AuthItem{
+		makeAccount("client", "secret"),
+		makeAccount("alice-pog", "alice-secret", "127.0.0.2"),
+		makeAccount("bob", "bob-password", "127.0.0.3"),
+	}
+	cfg := makeTestServerConfig(t)
+	var err error
+	cfg.EgressSource, err = NewEgressSourcePolicy(nil, serverAccounts)
+	require.NoError(t, err)
+
+	ai := &AuthInterceptor{AuthLst: serverAccounts}
+	server := grpc.NewServer(grpc.ChainStreamInterceptor(ai.ProcessStream))
+	RegisterProxySvc(server, cfg)
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	t.Cleanup(sc.Close)
+
+	conn, err := grpc.Dial(sc.Addr.String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(BasicAuthCredentials{Auth: "client:secret"}),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	alice := makeAccount("alice", "alice-password")
+	alice.POGAuth = "alice-pog:alice-secret"
+	clientAccounts := []AuthItem{alice, makeAccount("bob", "bob-password")}
+
+	pcc, err := NewProxyClientContext(pb.NewHTTPProxyClient(conn))
+	require.NoError(t, err)
+	pcc.AuthLst = clientAccounts
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	addr := startWhoAmIServer(t)
+	whoAmIAs := func(user, pass string) string {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", addr, addr, auth)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err = conn.Write([]byte("?"))
+		require.NoError(t, err)
+		b, err := io.ReadAll(br)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		fmt.Fprint(w, host)
+	}))
+	defer backend.Close()
+	getAs := func(user, pass string) string {
+		u := *proxyURL
+		u.User = url.UserPassword(user, pass)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&u)}}
+		resp, err := client.Get(backend.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	socksAs := func(user, pass string) string {
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, &proxy.Auth{User: user, Password: pass}, proxy.Direct)
+		require.NoError(t, err)
+		conn, err := dialer.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("?"))
+		require.NoError(t, err)
+		b, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	check := func(alice, bob string) {
+		require.Equal(t, alice, whoAmIAs("alice", "alice-password"))
+		require.Equal(t, bob, whoAmIAs("bob", "bob-password"))
+		require.Equal(t, alice, getAs("alice", "alice-password"))
+		require.Equal(t, bob, getAs("bob", "bob-password"))
+		require.Equal(t, alice, socksAs("alice", "alice-password"))
+		require.Equal(t, bob, socksAs("bob", "bob-password"))
+	}
+
+	// the mapping, bob goes as the client
+	pcc.POGAuth = NewPOGAuthMap(clientAccounts, false)
+	check("127.0.0.2", "127.0.0.1")
+
+	// the mapping and passthrough for bob
+	pcc.POGAuth = NewPOGAuthMap(clientAccounts, true)
+	check("127.0.0.2", "127.0.0.3")
+
+	// own credentials bypass the shared Mux stream
+	pcc.EnableMux()
+	check("127.0.0.2", "127.0.0.3")
+
+	// named servers go with their own auth unless user_auth
+	for userAuth, expected := range map[bool]string{false: "127.0.0.1", true: "127.0.0.2"} {
+		named := &NextHop{Name: "named", Addr: sc.Addr.String(), Auth: "client:secret", Insecure: true, UserAuth: userAuth}
+		pcc.Servers, err = NewServerRouter([]*NextHop{named}, []string{"named *"})
+		require.NoError(t, err)
+		require.Equal(t, expected, whoAmIAs("alice", "alice-password"))
+		pcc.Servers.Close()
+	}
+	pcc.Servers = nil
+
+	// a user has a single keep-alive transport, of the last credentials
+	transport := pcc.tunnelTransport("bob", "bob:password1")
+	require.Same(t, transport, pcc.tunnelTransport("bob", "bob:password1"))
+	require.NotSame(t, transport, pcc.tunnelTransport("bob", "bob:password2"))
+	require.Len(t, pcc.userTransports, 2)
+
+	require.Nil(t, NewPOGAuthMap(clientAccounts[1:], false))
+}
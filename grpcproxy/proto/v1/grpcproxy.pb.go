@@ -1,6 +1,6 @@
 // Code generated by protoc-gen-go. DO NOT EDIT.
 // versions:
-// 	protoc-gen-go v1.28.1
+// 	protoc-gen-go v1.31.0
 // 	protoc        v4.25.1
 // source: grpcproxy/proto/v1/grpcproxy.proto
 
@@ -26,10 +26,13 @@ type Packet struct {
 	unknownFields protoimpl.UnknownFields
 
 	// Types that are assignable to Union:
-	//
 	//	*Packet_Payload
 	//	*Packet_ConnectRequest
 	//	*Packet_ConnectResponse
+	//	*Packet_UdpAssociateRequest
+	//	*Packet_Datagram
+	//	*Packet_EndOfStream
+	//	*Packet_ReverseAcceptRequest
 	Union isPacket_Union `protobuf_oneof:"union"`
 }
 
@@ -93,53 +96,690 @@ func (x *Packet) GetConnectResponse() *ConnectResponse {
 	return nil
 }
 
+func (x *Packet) GetUdpAssociateRequest() *UDPAssociateRequest {
+	if x, ok := x.GetUnion().(*Packet_UdpAssociateRequest); ok {
+		return x.UdpAssociateRequest
+	}
+	return nil
+}
+
+func (x *Packet) GetDatagram() *Datagram {
+	if x, ok := x.GetUnion().(*Packet_Datagram); ok {
+		return x.Datagram
+	}
+	return nil
+}
+
+func (x *Packet) GetEndOfStream() *EndOfStream {
+	if x, ok := x.GetUnion().(*Packet_EndOfStream); ok {
+		return x.EndOfStream
+	}
+	return nil
+}
+
+func (x *Packet) GetReverseAcceptRequest() *ReverseAcceptRequest {
+	if x, ok := x.GetUnion().(*Packet_ReverseAcceptRequest); ok {
+		return x.ReverseAcceptRequest
+	}
+	return nil
+}
+
 type isPacket_Union interface {
 	isPacket_Union()
 }
 
-type Packet_Payload struct {
-	Payload []byte `protobuf:"bytes,1,opt,name=payload,proto3,oneof"`
+type Packet_Payload struct {
+	Payload []byte `protobuf:"bytes,1,opt,name=payload,proto3,oneof"`
+}
+
+type Packet_ConnectRequest struct {
+	ConnectRequest *ConnectRequest `protobuf:"bytes,2,opt,name=connect_request,json=connectRequest,proto3,oneof"`
+}
+
+type Packet_ConnectResponse struct {
+	ConnectResponse *ConnectResponse `protobuf:"bytes,3,opt,name=connect_response,json=connectResponse,proto3,oneof"`
+}
+
+type Packet_UdpAssociateRequest struct {
+	UdpAssociateRequest *UDPAssociateRequest `protobuf:"bytes,4,opt,name=udp_associate_request,json=udpAssociateRequest,proto3,oneof"`
+}
+
+type Packet_Datagram struct {
+	Datagram *Datagram `protobuf:"bytes,5,opt,name=datagram,proto3,oneof"`
+}
+
+type Packet_EndOfStream struct {
+	// the sender will send no more payload (TCP half-close),
+	// but still receives it
+	EndOfStream *EndOfStream `protobuf:"bytes,6,opt,name=end_of_stream,json=endOfStream,proto3,oneof"`
+}
+
+type Packet_ReverseAcceptRequest struct {
+	ReverseAcceptRequest *ReverseAcceptRequest `protobuf:"bytes,7,opt,name=reverse_accept_request,json=reverseAcceptRequest,proto3,oneof"`
+}
+
+func (*Packet_Payload) isPacket_Union() {}
+
+func (*Packet_ConnectRequest) isPacket_Union() {}
+
+func (*Packet_ConnectResponse) isPacket_Union() {}
+
+func (*Packet_UdpAssociateRequest) isPacket_Union() {}
+
+func (*Packet_Datagram) isPacket_Union() {}
+
+func (*Packet_EndOfStream) isPacket_Union() {}
+
+func (*Packet_ReverseAcceptRequest) isPacket_Union() {}
+
+type EndOfStream struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *EndOfStream) Reset() {
+	*x = EndOfStream{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EndOfStream) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndOfStream) ProtoMessage() {}
+
+func (x *EndOfStream) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndOfStream.ProtoReflect.Descriptor instead.
+func (*EndOfStream) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{1}
+}
+
+type ConnectRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	HostPort string `protobuf:"bytes,1,opt,name=host_port,json=hostPort,proto3" json:"host_port,omitempty"`
+}
+
+func (x *ConnectRequest) Reset() {
+	*x = ConnectRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ConnectRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectRequest) ProtoMessage() {}
+
+func (x *ConnectRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectRequest.ProtoReflect.Descriptor instead.
+func (*ConnectRequest) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ConnectRequest) GetHostPort() string {
+	if x != nil {
+		return x.HostPort
+	}
+	return ""
+}
+
+type ConnectResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Error *HTTPError `protobuf:"bytes,1,opt,name=error,proto3,oneof" json:"error,omitempty"`
+}
+
+func (x *ConnectResponse) Reset() {
+	*x = ConnectResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ConnectResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConnectResponse) ProtoMessage() {}
+
+func (x *ConnectResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConnectResponse.ProtoReflect.Descriptor instead.
+func (*ConnectResponse) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ConnectResponse) GetError() *HTTPError {
+	if x != nil {
+		return x.Error
+	}
+	return nil
+}
+
+// switches the stream to datagram mode, the server answers with ConnectResponse;
+// then both sides exchange Datagram packets only
+type UDPAssociateRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *UDPAssociateRequest) Reset() {
+	*x = UDPAssociateRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UDPAssociateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UDPAssociateRequest) ProtoMessage() {}
+
+func (x *UDPAssociateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UDPAssociateRequest.ProtoReflect.Descriptor instead.
+func (*UDPAssociateRequest) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{4}
+}
+
+type Datagram struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// destination address for client->server datagrams,
+	// source address for server->client ones
+	HostPort string `protobuf:"bytes,1,opt,name=host_port,json=hostPort,proto3" json:"host_port,omitempty"`
+	Payload  []byte `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+}
+
+func (x *Datagram) Reset() {
+	*x = Datagram{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Datagram) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Datagram) ProtoMessage() {}
+
+func (x *Datagram) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Datagram.ProtoReflect.Descriptor instead.
+func (*Datagram) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Datagram) GetHostPort() string {
+	if x != nil {
+		return x.HostPort
+	}
+	return ""
+}
+
+func (x *Datagram) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+type HTTPError struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	StatusCode int32  `protobuf:"varint,1,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
+	Error      string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *HTTPError) Reset() {
+	*x = HTTPError{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *HTTPError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HTTPError) ProtoMessage() {}
+
+func (x *HTTPError) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HTTPError.ProtoReflect.Descriptor instead.
+func (*HTTPError) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *HTTPError) GetStatusCode() int32 {
+	if x != nil {
+		return x.StatusCode
+	}
+	return 0
+}
+
+func (x *HTTPError) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+// either name or port is set
+type ListenRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// host name to route inbound connections by (TLS SNI or HTTP Host),
+	// they come to the server' shared reverse listener
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// a dedicated TCP port on the server
+	Port uint32 `protobuf:"varint,2,opt,name=port,proto3" json:"port,omitempty"`
+}
+
+func (x *ListenRequest) Reset() {
+	*x = ListenRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListenRequest) ProtoMessage() {}
+
+func (x *ListenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListenRequest.ProtoReflect.Descriptor instead.
+func (*ListenRequest) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListenRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *ListenRequest) GetPort() uint32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+type ListenEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Union:
+	//	*ListenEvent_Ready
+	//	*ListenEvent_Inbound
+	Union isListenEvent_Union `protobuf_oneof:"union"`
+}
+
+func (x *ListenEvent) Reset() {
+	*x = ListenEvent{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListenEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListenEvent) ProtoMessage() {}
+
+func (x *ListenEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListenEvent.ProtoReflect.Descriptor instead.
+func (*ListenEvent) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{8}
+}
+
+func (m *ListenEvent) GetUnion() isListenEvent_Union {
+	if m != nil {
+		return m.Union
+	}
+	return nil
+}
+
+func (x *ListenEvent) GetReady() *ListenReady {
+	if x, ok := x.GetUnion().(*ListenEvent_Ready); ok {
+		return x.Ready
+	}
+	return nil
+}
+
+func (x *ListenEvent) GetInbound() *InboundConnection {
+	if x, ok := x.GetUnion().(*ListenEvent_Inbound); ok {
+		return x.Inbound
+	}
+	return nil
+}
+
+type isListenEvent_Union interface {
+	isListenEvent_Union()
+}
+
+type ListenEvent_Ready struct {
+	// the first event, the listener is registered
+	Ready *ListenReady `protobuf:"bytes,1,opt,name=ready,proto3,oneof"`
+}
+
+type ListenEvent_Inbound struct {
+	Inbound *InboundConnection `protobuf:"bytes,2,opt,name=inbound,proto3,oneof"`
+}
+
+func (*ListenEvent_Ready) isListenEvent_Union() {}
+
+func (*ListenEvent_Inbound) isListenEvent_Union() {}
+
+type ListenReady struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// where the listener accepts connections
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+}
+
+func (x *ListenReady) Reset() {
+	*x = ListenReady{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[9]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ListenReady) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListenReady) ProtoMessage() {}
+
+func (x *ListenReady) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[9]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListenReady.ProtoReflect.Descriptor instead.
+func (*ListenReady) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *ListenReady) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type InboundConnection struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id         uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	RemoteAddr string `protobuf:"bytes,2,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+}
+
+func (x *InboundConnection) Reset() {
+	*x = InboundConnection{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[10]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *InboundConnection) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InboundConnection) ProtoMessage() {}
+
+func (x *InboundConnection) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[10]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InboundConnection.ProtoReflect.Descriptor instead.
+func (*InboundConnection) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{10}
 }
 
-type Packet_ConnectRequest struct {
-	ConnectRequest *ConnectRequest `protobuf:"bytes,2,opt,name=connect_request,json=connectRequest,proto3,oneof"`
+func (x *InboundConnection) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
 }
 
-type Packet_ConnectResponse struct {
-	ConnectResponse *ConnectResponse `protobuf:"bytes,3,opt,name=connect_response,json=connectResponse,proto3,oneof"`
+func (x *InboundConnection) GetRemoteAddr() string {
+	if x != nil {
+		return x.RemoteAddr
+	}
+	return ""
 }
 
-func (*Packet_Payload) isPacket_Union() {}
+// the stream carries the inbound connection of InboundConnection.id,
+// the server answers with ConnectResponse
+type ReverseAcceptRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
 
-func (*Packet_ConnectRequest) isPacket_Union() {}
+	Id uint64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+}
 
-func (*Packet_ConnectResponse) isPacket_Union() {}
+func (x *ReverseAcceptRequest) Reset() {
+	*x = ReverseAcceptRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[11]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
 
-type ConnectRequest struct {
+func (x *ReverseAcceptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReverseAcceptRequest) ProtoMessage() {}
+
+func (x *ReverseAcceptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[11]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReverseAcceptRequest.ProtoReflect.Descriptor instead.
+func (*ReverseAcceptRequest) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ReverseAcceptRequest) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type MuxFrame struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	HostPort string `protobuf:"bytes,1,opt,name=host_port,json=hostPort,proto3" json:"host_port,omitempty"`
+	// logical stream, chosen by the client; 0 is for the session itself
+	StreamId uint32 `protobuf:"varint,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	// Types that are assignable to Union:
+	//	*MuxFrame_Hello
+	//	*MuxFrame_Packet
+	//	*MuxFrame_Close
+	//	*MuxFrame_WindowUpdate
+	Union isMuxFrame_Union `protobuf_oneof:"union"`
 }
 
-func (x *ConnectRequest) Reset() {
-	*x = ConnectRequest{}
+func (x *MuxFrame) Reset() {
+	*x = MuxFrame{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[1]
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[12]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *ConnectRequest) String() string {
+func (x *MuxFrame) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ConnectRequest) ProtoMessage() {}
+func (*MuxFrame) ProtoMessage() {}
 
-func (x *ConnectRequest) ProtoReflect() protoreflect.Message {
-	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[1]
+func (x *MuxFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[12]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -150,43 +790,112 @@ func (x *ConnectRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ConnectRequest.ProtoReflect.Descriptor instead.
-func (*ConnectRequest) Descriptor() ([]byte, []int) {
-	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{1}
+// Deprecated: Use MuxFrame.ProtoReflect.Descriptor instead.
+func (*MuxFrame) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{12}
 }
 
-func (x *ConnectRequest) GetHostPort() string {
+func (x *MuxFrame) GetStreamId() uint32 {
 	if x != nil {
-		return x.HostPort
+		return x.StreamId
 	}
-	return ""
+	return 0
 }
 
-type ConnectResponse struct {
+func (m *MuxFrame) GetUnion() isMuxFrame_Union {
+	if m != nil {
+		return m.Union
+	}
+	return nil
+}
+
+func (x *MuxFrame) GetHello() *MuxHello {
+	if x, ok := x.GetUnion().(*MuxFrame_Hello); ok {
+		return x.Hello
+	}
+	return nil
+}
+
+func (x *MuxFrame) GetPacket() *Packet {
+	if x, ok := x.GetUnion().(*MuxFrame_Packet); ok {
+		return x.Packet
+	}
+	return nil
+}
+
+func (x *MuxFrame) GetClose() *MuxClose {
+	if x, ok := x.GetUnion().(*MuxFrame_Close); ok {
+		return x.Close
+	}
+	return nil
+}
+
+func (x *MuxFrame) GetWindowUpdate() uint32 {
+	if x, ok := x.GetUnion().(*MuxFrame_WindowUpdate); ok {
+		return x.WindowUpdate
+	}
+	return 0
+}
+
+type isMuxFrame_Union interface {
+	isMuxFrame_Union()
+}
+
+type MuxFrame_Hello struct {
+	// the first frame the server sends, with stream_id = 0
+	Hello *MuxHello `protobuf:"bytes,2,opt,name=hello,proto3,oneof"`
+}
+
+type MuxFrame_Packet struct {
+	// the same as a Run packet; a new stream starts with
+	// ConnectRequest, UDPAssociateRequest or ReverseAcceptRequest
+	Packet *Packet `protobuf:"bytes,3,opt,name=packet,proto3,oneof"`
+}
+
+type MuxFrame_Close struct {
+	// the sender will not send on the stream any more
+	Close *MuxClose `protobuf:"bytes,4,opt,name=close,proto3,oneof"`
+}
+
+type MuxFrame_WindowUpdate struct {
+	// the receiver has consumed that many payload bytes, so
+	// the sender may send them more
+	WindowUpdate uint32 `protobuf:"varint,5,opt,name=window_update,json=windowUpdate,proto3,oneof"`
+}
+
+func (*MuxFrame_Hello) isMuxFrame_Union() {}
+
+func (*MuxFrame_Packet) isMuxFrame_Union() {}
+
+func (*MuxFrame_Close) isMuxFrame_Union() {}
+
+func (*MuxFrame_WindowUpdate) isMuxFrame_Union() {}
+
+type MuxHello struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Error *HTTPError `protobuf:"bytes,1,opt,name=error,proto3,oneof" json:"error,omitempty"`
+	Version uint32 `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
 }
 
-func (x *ConnectResponse) Reset() {
-	*x = ConnectResponse{}
+func (x *MuxHello) Reset() {
+	*x = MuxHello{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2]
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[13]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *ConnectResponse) String() string {
+func (x *MuxHello) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ConnectResponse) ProtoMessage() {}
+func (*MuxHello) ProtoMessage() {}
 
-func (x *ConnectResponse) ProtoReflect() protoreflect.Message {
-	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2]
+func (x *MuxHello) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[13]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -197,44 +906,45 @@ func (x *ConnectResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ConnectResponse.ProtoReflect.Descriptor instead.
-func (*ConnectResponse) Descriptor() ([]byte, []int) {
-	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{2}
+// Deprecated: Use MuxHello.ProtoReflect.Descriptor instead.
+func (*MuxHello) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{13}
 }
 
-func (x *ConnectResponse) GetError() *HTTPError {
+func (x *MuxHello) GetVersion() uint32 {
 	if x != nil {
-		return x.Error
+		return x.Version
 	}
-	return nil
+	return 0
 }
 
-type HTTPError struct {
+type MuxClose struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	StatusCode int32  `protobuf:"varint,1,opt,name=status_code,json=statusCode,proto3" json:"status_code,omitempty"`
-	Error      string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	// gRPC status the logical stream ends with, OK if not set
+	Code    int32  `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
 }
 
-func (x *HTTPError) Reset() {
-	*x = HTTPError{}
+func (x *MuxClose) Reset() {
+	*x = MuxClose{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3]
+		mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[14]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
 }
 
-func (x *HTTPError) String() string {
+func (x *MuxClose) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*HTTPError) ProtoMessage() {}
+func (*MuxClose) ProtoMessage() {}
 
-func (x *HTTPError) ProtoReflect() protoreflect.Message {
-	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3]
+func (x *MuxClose) ProtoReflect() protoreflect.Message {
+	mi := &file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[14]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -245,21 +955,21 @@ func (x *HTTPError) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use HTTPError.ProtoReflect.Descriptor instead.
-func (*HTTPError) Descriptor() ([]byte, []int) {
-	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{3}
+// Deprecated: Use MuxClose.ProtoReflect.Descriptor instead.
+func (*MuxClose) Descriptor() ([]byte, []int) {
+	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP(), []int{14}
 }
 
-func (x *HTTPError) GetStatusCode() int32 {
+func (x *MuxClose) GetCode() int32 {
 	if x != nil {
-		return x.StatusCode
+		return x.Code
 	}
 	return 0
 }
 
-func (x *HTTPError) GetError() string {
+func (x *MuxClose) GetMessage() string {
 	if x != nil {
-		return x.Error
+		return x.Message
 	}
 	return ""
 }
@@ -269,7 +979,7 @@ var File_grpcproxy_proto_v1_grpcproxy_proto protoreflect.FileDescriptor
 var file_grpcproxy_proto_v1_grpcproxy_proto_rawDesc = []byte{
 	0x0a, 0x22, 0x67, 0x72, 0x70, 0x63, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x70, 0x72, 0x6f, 0x74,
 	0x6f, 0x2f, 0x76, 0x31, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2e, 0x70,
-	0x72, 0x6f, 0x74, 0x6f, 0x22, 0xa8, 0x01, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12,
+	0x72, 0x6f, 0x74, 0x6f, 0x22, 0xa0, 0x03, 0x0a, 0x06, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x12,
 	0x1a, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
 	0x48, 0x00, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x3a, 0x0a, 0x0f, 0x63,
 	0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x5f, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x02,
@@ -279,25 +989,90 @@ var file_grpcproxy_proto_v1_grpcproxy_proto_rawDesc = []byte{
 	0x63, 0x74, 0x5f, 0x72, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
 	0x0b, 0x32, 0x10, 0x2e, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f,
 	0x6e, 0x73, 0x65, 0x48, 0x00, 0x52, 0x0f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x52, 0x65,
-	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x42, 0x07, 0x0a, 0x05, 0x75, 0x6e, 0x69, 0x6f, 0x6e, 0x22,
-	0x2d, 0x0a, 0x0e, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
-	0x74, 0x12, 0x1b, 0x0a, 0x09, 0x68, 0x6f, 0x73, 0x74, 0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73, 0x74, 0x50, 0x6f, 0x72, 0x74, 0x22, 0x42,
-	0x0a, 0x0f, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
-	0x65, 0x12, 0x25, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
-	0x32, 0x0a, 0x2e, 0x48, 0x54, 0x54, 0x50, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x48, 0x00, 0x52, 0x05,
-	0x65, 0x72, 0x72, 0x6f, 0x72, 0x88, 0x01, 0x01, 0x42, 0x08, 0x0a, 0x06, 0x5f, 0x65, 0x72, 0x72,
-	0x6f, 0x72, 0x22, 0x42, 0x0a, 0x09, 0x48, 0x54, 0x54, 0x50, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12,
-	0x1f, 0x0a, 0x0b, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64, 0x65,
-	0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
-	0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x32, 0x2a, 0x0a, 0x09, 0x48, 0x54, 0x54, 0x50, 0x50, 0x72,
-	0x6f, 0x78, 0x79, 0x12, 0x1d, 0x0a, 0x03, 0x52, 0x75, 0x6e, 0x12, 0x07, 0x2e, 0x50, 0x61, 0x63,
-	0x6b, 0x65, 0x74, 0x1a, 0x07, 0x2e, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x22, 0x00, 0x28, 0x01,
-	0x30, 0x01, 0x42, 0x32, 0x5a, 0x30, 0x67, 0x69, 0x74, 0x2e, 0x63, 0x61, 0x74, 0x62, 0x6f, 0x2e,
-	0x6e, 0x65, 0x74, 0x2f, 0x6d, 0x75, 0x72, 0x61, 0x76, 0x6a, 0x6f, 0x76, 0x2f, 0x67, 0x6f, 0x32,
-	0x30, 0x32, 0x33, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x2f, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x4a, 0x0a, 0x15, 0x75, 0x64, 0x70, 0x5f, 0x61, 0x73,
+	0x73, 0x6f, 0x63, 0x69, 0x61, 0x74, 0x65, 0x5f, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x55, 0x44, 0x50, 0x41, 0x73, 0x73, 0x6f, 0x63,
+	0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x13, 0x75,
+	0x64, 0x70, 0x41, 0x73, 0x73, 0x6f, 0x63, 0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x27, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x18, 0x05,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x09, 0x2e, 0x44, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x48,
+	0x00, 0x52, 0x08, 0x64, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x12, 0x32, 0x0a, 0x0d, 0x65,
+	0x6e, 0x64, 0x5f, 0x6f, 0x66, 0x5f, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x18, 0x06, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x45, 0x6e, 0x64, 0x4f, 0x66, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x48, 0x00, 0x52, 0x0b, 0x65, 0x6e, 0x64, 0x4f, 0x66, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x12,
+	0x4d, 0x0a, 0x16, 0x72, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x5f, 0x61, 0x63, 0x63, 0x65, 0x70,
+	0x74, 0x5f, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x15, 0x2e, 0x52, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x48, 0x00, 0x52, 0x14, 0x72, 0x65, 0x76, 0x65, 0x72, 0x73,
+	0x65, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x42, 0x07,
+	0x0a, 0x05, 0x75, 0x6e, 0x69, 0x6f, 0x6e, 0x22, 0x0d, 0x0a, 0x0b, 0x45, 0x6e, 0x64, 0x4f, 0x66,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x22, 0x2d, 0x0a, 0x0e, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63,
+	0x74, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1b, 0x0a, 0x09, 0x68, 0x6f, 0x73, 0x74,
+	0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73,
+	0x74, 0x50, 0x6f, 0x72, 0x74, 0x22, 0x42, 0x0a, 0x0f, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74,
+	0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x25, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f,
+	0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0a, 0x2e, 0x48, 0x54, 0x54, 0x50, 0x45, 0x72,
+	0x72, 0x6f, 0x72, 0x48, 0x00, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x88, 0x01, 0x01, 0x42,
+	0x08, 0x0a, 0x06, 0x5f, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x15, 0x0a, 0x13, 0x55, 0x44, 0x50,
+	0x41, 0x73, 0x73, 0x6f, 0x63, 0x69, 0x61, 0x74, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x22, 0x41, 0x0a, 0x08, 0x44, 0x61, 0x74, 0x61, 0x67, 0x72, 0x61, 0x6d, 0x12, 0x1b, 0x0a, 0x09,
+	0x68, 0x6f, 0x73, 0x74, 0x5f, 0x70, 0x6f, 0x72, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x08, 0x68, 0x6f, 0x73, 0x74, 0x50, 0x6f, 0x72, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x70, 0x61, 0x79,
+	0x6c, 0x6f, 0x61, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x07, 0x70, 0x61, 0x79, 0x6c,
+	0x6f, 0x61, 0x64, 0x22, 0x42, 0x0a, 0x09, 0x48, 0x54, 0x54, 0x50, 0x45, 0x72, 0x72, 0x6f, 0x72,
+	0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x5f, 0x63, 0x6f, 0x64, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x43, 0x6f, 0x64,
+	0x65, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x37, 0x0a, 0x0d, 0x4c, 0x69, 0x73, 0x74, 0x65,
+	0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6e, 0x61, 0x6d, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x70, 0x6f, 0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x70, 0x6f, 0x72, 0x74,
+	0x22, 0x6c, 0x0a, 0x0b, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12,
+	0x24, 0x0a, 0x05, 0x72, 0x65, 0x61, 0x64, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c,
+	0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x61, 0x64, 0x79, 0x48, 0x00, 0x52, 0x05,
+	0x72, 0x65, 0x61, 0x64, 0x79, 0x12, 0x2e, 0x0a, 0x07, 0x69, 0x6e, 0x62, 0x6f, 0x75, 0x6e, 0x64,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x49, 0x6e, 0x62, 0x6f, 0x75, 0x6e, 0x64,
+	0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52, 0x07, 0x69, 0x6e,
+	0x62, 0x6f, 0x75, 0x6e, 0x64, 0x42, 0x07, 0x0a, 0x05, 0x75, 0x6e, 0x69, 0x6f, 0x6e, 0x22, 0x27,
+	0x0a, 0x0b, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x61, 0x64, 0x79, 0x12, 0x18, 0x0a,
+	0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07,
+	0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0x44, 0x0a, 0x11, 0x49, 0x6e, 0x62, 0x6f, 0x75,
+	0x6e, 0x64, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x0e, 0x0a, 0x02,
+	0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x02, 0x69, 0x64, 0x12, 0x1f, 0x0a, 0x0b,
+	0x72, 0x65, 0x6d, 0x6f, 0x74, 0x65, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0a, 0x72, 0x65, 0x6d, 0x6f, 0x74, 0x65, 0x41, 0x64, 0x64, 0x72, 0x22, 0x26, 0x0a,
+	0x14, 0x52, 0x65, 0x76, 0x65, 0x72, 0x73, 0x65, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x04, 0x52, 0x02, 0x69, 0x64, 0x22, 0xc0, 0x01, 0x0a, 0x08, 0x4d, 0x75, 0x78, 0x46, 0x72, 0x61,
+	0x6d, 0x65, 0x12, 0x1b, 0x0a, 0x09, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x5f, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x73, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x49, 0x64, 0x12,
+	0x21, 0x0a, 0x05, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x09,
+	0x2e, 0x4d, 0x75, 0x78, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x48, 0x00, 0x52, 0x05, 0x68, 0x65, 0x6c,
+	0x6c, 0x6f, 0x12, 0x21, 0x0a, 0x06, 0x70, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x07, 0x2e, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x48, 0x00, 0x52, 0x06, 0x70,
+	0x61, 0x63, 0x6b, 0x65, 0x74, 0x12, 0x21, 0x0a, 0x05, 0x63, 0x6c, 0x6f, 0x73, 0x65, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x09, 0x2e, 0x4d, 0x75, 0x78, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x48,
+	0x00, 0x52, 0x05, 0x63, 0x6c, 0x6f, 0x73, 0x65, 0x12, 0x25, 0x0a, 0x0d, 0x77, 0x69, 0x6e, 0x64,
+	0x6f, 0x77, 0x5f, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x48,
+	0x00, 0x52, 0x0c, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x42,
+	0x07, 0x0a, 0x05, 0x75, 0x6e, 0x69, 0x6f, 0x6e, 0x22, 0x24, 0x0a, 0x08, 0x4d, 0x75, 0x78, 0x48,
+	0x65, 0x6c, 0x6c, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x22, 0x38,
+	0x0a, 0x08, 0x4d, 0x75, 0x78, 0x43, 0x6c, 0x6f, 0x73, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x6f,
+	0x64, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x63, 0x6f, 0x64, 0x65, 0x12, 0x18,
+	0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x32, 0x79, 0x0a, 0x09, 0x48, 0x54, 0x54, 0x50,
+	0x50, 0x72, 0x6f, 0x78, 0x79, 0x12, 0x1d, 0x0a, 0x03, 0x52, 0x75, 0x6e, 0x12, 0x07, 0x2e, 0x50,
+	0x61, 0x63, 0x6b, 0x65, 0x74, 0x1a, 0x07, 0x2e, 0x50, 0x61, 0x63, 0x6b, 0x65, 0x74, 0x22, 0x00,
+	0x28, 0x01, 0x30, 0x01, 0x12, 0x21, 0x0a, 0x03, 0x4d, 0x75, 0x78, 0x12, 0x09, 0x2e, 0x4d, 0x75,
+	0x78, 0x46, 0x72, 0x61, 0x6d, 0x65, 0x1a, 0x09, 0x2e, 0x4d, 0x75, 0x78, 0x46, 0x72, 0x61, 0x6d,
+	0x65, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x12, 0x2a, 0x0a, 0x06, 0x4c, 0x69, 0x73, 0x74, 0x65,
+	0x6e, 0x12, 0x0e, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x1a, 0x0c, 0x2e, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x22,
+	0x00, 0x30, 0x01, 0x42, 0x32, 0x5a, 0x30, 0x67, 0x69, 0x74, 0x2e, 0x63, 0x61, 0x74, 0x62, 0x6f,
+	0x2e, 0x6e, 0x65, 0x74, 0x2f, 0x6d, 0x75, 0x72, 0x61, 0x76, 0x6a, 0x6f, 0x76, 0x2f, 0x67, 0x6f,
+	0x32, 0x30, 0x32, 0x33, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x2f, 0x76, 0x31, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -312,24 +1087,48 @@ func file_grpcproxy_proto_v1_grpcproxy_proto_rawDescGZIP() []byte {
 	return file_grpcproxy_proto_v1_grpcproxy_proto_rawDescData
 }
 
-var file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
 var file_grpcproxy_proto_v1_grpcproxy_proto_goTypes = []interface{}{
-	(*Packet)(nil),          // 0: Packet
-	(*ConnectRequest)(nil),  // 1: ConnectRequest
-	(*ConnectResponse)(nil), // 2: ConnectResponse
-	(*HTTPError)(nil),       // 3: HTTPError
+	(*Packet)(nil),               // 0: Packet
+	(*EndOfStream)(nil),          // 1: EndOfStream
+	(*ConnectRequest)(nil),       // 2: ConnectRequest
+	(*ConnectResponse)(nil),      // 3: ConnectResponse
+	(*UDPAssociateRequest)(nil),  // 4: UDPAssociateRequest
+	(*Datagram)(nil),             // 5: Datagram
+	(*HTTPError)(nil),            // 6: HTTPError
+	(*ListenRequest)(nil),        // 7: ListenRequest
+	(*ListenEvent)(nil),          // 8: ListenEvent
+	(*ListenReady)(nil),          // 9: ListenReady
+	(*InboundConnection)(nil),    // 10: InboundConnection
+	(*ReverseAcceptRequest)(nil), // 11: ReverseAcceptRequest
+	(*MuxFrame)(nil),             // 12: MuxFrame
+	(*MuxHello)(nil),             // 13: MuxHello
+	(*MuxClose)(nil),             // 14: MuxClose
 }
 var file_grpcproxy_proto_v1_grpcproxy_proto_depIdxs = []int32{
-	1, // 0: Packet.connect_request:type_name -> ConnectRequest
-	2, // 1: Packet.connect_response:type_name -> ConnectResponse
-	3, // 2: ConnectResponse.error:type_name -> HTTPError
-	0, // 3: HTTPProxy.Run:input_type -> Packet
-	0, // 4: HTTPProxy.Run:output_type -> Packet
-	4, // [4:5] is the sub-list for method output_type
-	3, // [3:4] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	2,  // 0: Packet.connect_request:type_name -> ConnectRequest
+	3,  // 1: Packet.connect_response:type_name -> ConnectResponse
+	4,  // 2: Packet.udp_associate_request:type_name -> UDPAssociateRequest
+	5,  // 3: Packet.datagram:type_name -> Datagram
+	1,  // 4: Packet.end_of_stream:type_name -> EndOfStream
+	11, // 5: Packet.reverse_accept_request:type_name -> ReverseAcceptRequest
+	6,  // 6: ConnectResponse.error:type_name -> HTTPError
+	9,  // 7: ListenEvent.ready:type_name -> ListenReady
+	10, // 8: ListenEvent.inbound:type_name -> InboundConnection
+	13, // 9: MuxFrame.hello:type_name -> MuxHello
+	0,  // 10: MuxFrame.packet:type_name -> Packet
+	14, // 11: MuxFrame.close:type_name -> MuxClose
+	0,  // 12: HTTPProxy.Run:input_type -> Packet
+	12, // 13: HTTPProxy.Mux:input_type -> MuxFrame
+	7,  // 14: HTTPProxy.Listen:input_type -> ListenRequest
+	0,  // 15: HTTPProxy.Run:output_type -> Packet
+	12, // 16: HTTPProxy.Mux:output_type -> MuxFrame
+	8,  // 17: HTTPProxy.Listen:output_type -> ListenEvent
+	15, // [15:18] is the sub-list for method output_type
+	12, // [12:15] is the sub-list for method input_type
+	12, // [12:12] is the sub-list for extension type_name
+	12, // [12:12] is the sub-list for extension extendee
+	0,  // [0:12] is the sub-list for field type_name
 }
 
 func init() { file_grpcproxy_proto_v1_grpcproxy_proto_init() }
@@ -351,7 +1150,7 @@ func file_grpcproxy_proto_v1_grpcproxy_proto_init() {
 			}
 		}
 		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ConnectRequest); i {
+			switch v := v.(*EndOfStream); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -363,7 +1162,7 @@ func file_grpcproxy_proto_v1_grpcproxy_proto_init() {
 			}
 		}
 		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*ConnectResponse); i {
+			switch v := v.(*ConnectRequest); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -375,6 +1174,42 @@ func file_grpcproxy_proto_v1_grpcproxy_proto_init() {
 			}
 		}
 		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ConnectResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UDPAssociateRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Datagram); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*HTTPError); i {
 			case 0:
 				return &v.state
@@ -386,20 +1221,130 @@ func file_grpcproxy_proto_v1_grpcproxy_proto_init() {
 				return nil
 			}
 		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListenRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListenEvent); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[9].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ListenReady); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[10].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*InboundConnection); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[11].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ReverseAcceptRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[12].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MuxFrame); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[13].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MuxHello); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[14].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MuxClose); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[0].OneofWrappers = []interface{}{
 		(*Packet_Payload)(nil),
 		(*Packet_ConnectRequest)(nil),
 		(*Packet_ConnectResponse)(nil),
+		(*Packet_UdpAssociateRequest)(nil),
+		(*Packet_Datagram)(nil),
+		(*Packet_EndOfStream)(nil),
+		(*Packet_ReverseAcceptRequest)(nil),
+	}
+	file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[3].OneofWrappers = []interface{}{}
+	file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[8].OneofWrappers = []interface{}{
+		(*ListenEvent_Ready)(nil),
+		(*ListenEvent_Inbound)(nil),
+	}
+	file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[12].OneofWrappers = []interface{}{
+		(*MuxFrame_Hello)(nil),
+		(*MuxFrame_Packet)(nil),
+		(*MuxFrame_Close)(nil),
+		(*MuxFrame_WindowUpdate)(nil),
 	}
-	file_grpcproxy_proto_v1_grpcproxy_proto_msgTypes[2].OneofWrappers = []interface{}{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_grpcproxy_proto_v1_grpcproxy_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   4,
+			NumMessages:   15,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
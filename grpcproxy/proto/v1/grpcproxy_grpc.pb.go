@@ -23,6 +23,12 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type HTTPProxyClient interface {
 	Run(ctx context.Context, opts ...grpc.CallOption) (HTTPProxy_RunClient, error)
+	// many Run-like logical streams over a single one
+	Mux(ctx context.Context, opts ...grpc.CallOption) (HTTPProxy_MuxClient, error)
+	// reverse tunnels: registers a listener on the server for as long as the call
+	// lasts; every inbound connection is announced with ListenEvent and is to be
+	// picked up with a ReverseAcceptRequest stream
+	Listen(ctx context.Context, in *ListenRequest, opts ...grpc.CallOption) (HTTPProxy_ListenClient, error)
 }
 
 type hTTPProxyClient struct {
@@ -64,11 +70,80 @@ func (x *hTTPProxyRunClient) Recv() (*Packet, error) {
 	return m, nil
 }
 
+func (c *hTTPProxyClient) Mux(ctx context.Context, opts ...grpc.CallOption) (HTTPProxy_MuxClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HTTPProxy_ServiceDesc.Streams[1], "/HTTPProxy/Mux", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &hTTPProxyMuxClient{stream}
+	return x, nil
+}
+
+type HTTPProxy_MuxClient interface {
+	Send(*MuxFrame) error
+	Recv() (*MuxFrame, error)
+	grpc.ClientStream
+}
+
+type hTTPProxyMuxClient struct {
+	grpc.ClientStream
+}
+
+func (x *hTTPProxyMuxClient) Send(m *MuxFrame) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *hTTPProxyMuxClient) Recv() (*MuxFrame, error) {
+	m := new(MuxFrame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *hTTPProxyClient) Listen(ctx context.Context, in *ListenRequest, opts ...grpc.CallOption) (HTTPProxy_ListenClient, error) {
+	stream, err := c.cc.NewStream(ctx, &HTTPProxy_ServiceDesc.Streams[2], "/HTTPProxy/Listen", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &hTTPProxyListenClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type HTTPProxy_ListenClient interface {
+	Recv() (*ListenEvent, error)
+	grpc.ClientStream
+}
+
+type hTTPProxyListenClient struct {
+	grpc.ClientStream
+}
+
+func (x *hTTPProxyListenClient) Recv() (*ListenEvent, error) {
+	m := new(ListenEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // HTTPProxyServer is the server API for HTTPProxy service.
 // All implementations must embed UnimplementedHTTPProxyServer
 // for forward compatibility
 type HTTPProxyServer interface {
 	Run(HTTPProxy_RunServer) error
+	// many Run-like logical streams over a single one
+	Mux(HTTPProxy_MuxServer) error
+	// reverse tunnels: registers a listener on the server for as long as the call
+	// lasts; every inbound connection is announced with ListenEvent and is to be
+	// picked up with a ReverseAcceptRequest stream
+	Listen(*ListenRequest, HTTPProxy_ListenServer) error
 	mustEmbedUnimplementedHTTPProxyServer()
 }
 
@@ -79,6 +154,12 @@ type UnimplementedHTTPProxyServer struct {
 func (UnimplementedHTTPProxyServer) Run(HTTPProxy_RunServer) error {
 	return status.Errorf(codes.Unimplemented, "method Run not implemented")
 }
+func (UnimplementedHTTPProxyServer) Mux(HTTPProxy_MuxServer) error {
+	return status.Errorf(codes.Unimplemented, "method Mux not implemented")
+}
+func (UnimplementedHTTPProxyServer) Listen(*ListenRequest, HTTPProxy_ListenServer) error {
+	return status.Errorf(codes.Unimplemented, "method Listen not implemented")
+}
 func (UnimplementedHTTPProxyServer) mustEmbedUnimplementedHTTPProxyServer() {}
 
 // UnsafeHTTPProxyServer may be embedded to opt out of forward compatibility for this service.
@@ -118,6 +199,53 @@ func (x *hTTPProxyRunServer) Recv() (*Packet, error) {
 	return m, nil
 }
 
+func _HTTPProxy_Mux_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(HTTPProxyServer).Mux(&hTTPProxyMuxServer{stream})
+}
+
+type HTTPProxy_MuxServer interface {
+	Send(*MuxFrame) error
+	Recv() (*MuxFrame, error)
+	grpc.ServerStream
+}
+
+type hTTPProxyMuxServer struct {
+	grpc.ServerStream
+}
+
+func (x *hTTPProxyMuxServer) Send(m *MuxFrame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *hTTPProxyMuxServer) Recv() (*MuxFrame, error) {
+	m := new(MuxFrame)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _HTTPProxy_Listen_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListenRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HTTPProxyServer).Listen(m, &hTTPProxyListenServer{stream})
+}
+
+type HTTPProxy_ListenServer interface {
+	Send(*ListenEvent) error
+	grpc.ServerStream
+}
+
+type hTTPProxyListenServer struct {
+	grpc.ServerStream
+}
+
+func (x *hTTPProxyListenServer) Send(m *ListenEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // HTTPProxy_ServiceDesc is the grpc.ServiceDesc for HTTPProxy service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -132,6 +260,17 @@ var HTTPProxy_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Mux",
+			Handler:       _HTTPProxy_Mux_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Listen",
+			Handler:       _HTTPProxy_Listen_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "grpcproxy/proto/v1/grpcproxy.proto",
 }
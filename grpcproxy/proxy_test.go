@@ -1,10 +1,17 @@
 package grpcproxy
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/bradfitz/iter"
@@ -60,7 +67,7 @@ func TestProxy(t *testing.T) {
 
 	server := grpc.NewServer()
 	// registering should be done before grpcapi.Server.Start() = grpc.Server.Serve()
-	RegisterProxySvc(server)
+	RegisterProxySvc(server, makeTestServerConfig(t))
 
 	sc, err := grpctest.StartServerClient(server)
 	require.NoError(t, err)
@@ -115,3 +122,189 @@ func TestProxy(t *testing.T) {
 		util.InvokeEndpoint(&endpoint, false, t)
 	}
 }
+
+func makeTestServerConfig(t *testing.T) ServerConfig {
+	cfg, err := MakeServerConfig(nil)
+	require.NoError(t, err)
+	// test destinations are on localhost
+	cfg.EgressGuard = nil
+	return cfg
+}
+
+// startLocalPOG runs pog server and client locally, returns the client' proxy URL
+func startLocalPOG(t *testing.T) (*url.URL, *ProxyClientContext) {
+	return startLocalPOGWithConfig(t, makeTestServerConfig(t))
+}
+
+func startLocalPOGWithConfig(t *testing.T, cfg ServerConfig) (*url.URL, *ProxyClientContext) {
+	server := grpc.NewServer()
+	RegisterProxySvc(server, cfg)
+
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	t.Cleanup(sc.Close)
+
+	pcc, err := NewProxyClientContext(pb.NewHTTPProxyClient(sc.Conn))
+	require.NoError(t, err)
+
+	return startLocalPOGClient(t, pcc), pcc
+}
+
+// startLocalPOGClient serves HTTP and SOCKS proxying with pcc, returns the proxy URL
+func startLocalPOGClient(t *testing.T, pcc *ProxyClientContext) *url.URL {
+	proxyServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ProxyHandler(w, r, pcc)
+	}))
+	// SOCKS is served on the same port
+	proxyServer.Listener = NewSOCKSDetectListener(proxyServer.Listener, pcc)
+	proxyServer.Start()
+	t.Cleanup(proxyServer.Close)
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+
+	return proxyURL
+}
+
+func TestHTTPForwarding(t *testing.T) {
+	var remoteAddrs sync.Map
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs.Store(r.RemoteAddr, true)
+
+		require.Empty(t, r.Header.Get("Proxy-Connection"))
+		require.Empty(t, r.Header.Get("X-Forwarded-For"))
+
+		w.Header().Set("X-Backend", "yes")
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	proxyURL, _ := startLocalPOG(t)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+
+	for range iter.N(3) {
+		resp, err := client.Post(backend.URL+"/path", "text/plain", strings.NewReader("body"))
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "yes", resp.Header.Get("X-Backend"))
+		require.Equal(t, "POST /path", string(body))
+	}
+
+	// keep-alive connection through the tunnel is reused
+	cnt := 0
+	remoteAddrs.Range(func(key, value any) bool {
+		cnt++
+		return true
+	})
+	require.Equal(t, 1, cnt)
+
+	// unreachable destination
+	l := grpctest.NewLocalListener()
+	addr := l.Addr().String()
+	l.Close()
+
+	resp, err := client.Get("http://" + addr)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestHTTPForwardingUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "echo", r.Header.Get("Upgrade"))
+
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "echo")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+
+	proxyURL, _ := startLocalPOG(t)
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", backend.URL, backend.Listener.Addr())
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ping\n", line)
+}
+
+// dialCONNECT opens a tunnel to addr via HTTP proxy
+func dialCONNECT(t *testing.T, proxyURL *url.URL, addr string) *net.TCPConn {
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+
+	// no body for 200 to CONNECT, so no bytes are buffered beyond the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	return conn.(*net.TCPConn)
+}
+
+func TestHalfClose(t *testing.T) {
+	// replies only after the request is over, like `nc -N` or HTTP/1.0 clients expect
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				b, _ := io.ReadAll(conn)
+				fmt.Fprintf(conn, "got %d bytes", len(b))
+			}()
+		}
+	}()
+
+	proxyURL, pcc := startLocalPOG(t)
+
+	check := func() {
+		conn := dialCONNECT(t, proxyURL, l.Addr().String())
+		defer conn.Close()
+
+		_, err := conn.Write([]byte("request"))
+		require.NoError(t, err)
+		require.NoError(t, conn.CloseWrite())
+
+		resp, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "got 7 bytes", string(resp))
+	}
+
+	check()
+
+	pcc.EnableMux()
+	check()
+}
@@ -0,0 +1,174 @@
+package grpcproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// quota periods of AuthItem.QuotaPeriod, in UTC
+const (
+	quotaPeriodDay   = "day"
+	quotaPeriodMonth = "month"
+)
+
+// periodKey names the period t is in, like "2024-06-15" or "2024-06"
+func periodKey(period string, t time.Time) string {
+	t = t.UTC()
+	if period == quotaPeriodDay {
+		return t.Format(time.DateOnly)
+	}
+	return t.Format("2006-01")
+}
+
+// periodEnd is when the quota is renewed
+func periodEnd(period string, t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	if period == quotaPeriodDay {
+		return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+type accountQuota struct {
+	limit  int64 // bytes per period, both directions
+	period string
+}
+
+// Quotas are traffic quotas of accounts, AuthItem.Quota and AuthItem.QuotaPeriod
+type Quotas struct {
+	store    UsageStore
+	accounts map[string]accountQuota
+}
+
+func NewQuotas(authLst []AuthItem, store UsageStore) (*Quotas, error) {
+	q := &Quotas{
+		store:    store,
+		accounts: map[string]accountQuota{},
+	}
+
+	for _, ai := range authLst {
+		if ai.Quota <= 0 {
+			continue
+		}
+
+		period := ai.QuotaPeriod
+		switch period {
+		case "":
+			period = quotaPeriodMonth
+		case quotaPeriodDay, quotaPeriodMonth:
+		default:
+			err := fmt.Errorf("bad quota_period %q of %v auth item, must be %q or %q", period, ai.Name, quotaPeriodDay, quotaPeriodMonth)
+			util.Error(err)
+			return nil, err
+		}
+
+		q.accounts[ai.Name] = accountQuota{ai.Quota, period}
+		q.ForUser(ai.Name).Check()
+	}
+
+	return q, nil
+}
+
+func (q *Quotas) Close() error {
+	if q == nil {
+		return nil
+	}
+	return q.store.Close()
+}
+
+// quotaAccount is the quota of a tunnel' account, nil if there is no quota
+type quotaAccount struct {
+	user  string
+	quota accountQuota
+	store UsageStore
+}
+
+func (q *Quotas) ForUser(user string) *quotaAccount {
+	if q == nil {
+		return nil
+	}
+
+	quota, ok := q.accounts[user]
+	if !ok {
+		return nil
+	}
+	return &quotaAccount{user, quota, q.store}
+}
+
+var errQuotaExhausted = errors.New("traffic quota is exhausted")
+
+func (qa *quotaAccount) exhaustedErr(now time.Time) error {
+	return status.Errorf(codes.ResourceExhausted, "%v: traffic quota of %d bytes per %s is exhausted till %s",
+		qa.user, qa.quota.limit, qa.quota.period, periodEnd(qa.quota.period, now).Format(time.RFC3339))
+}
+
+func (qa *quotaAccount) report(used int64) error {
+	remaining := max(qa.quota.limit-used, 0)
+	quotaRemainingBytes.WithLabelValues(qa.user).Set(float64(remaining))
+
+	if remaining == 0 {
+		return errQuotaExhausted
+	}
+	return nil
+}
+
+// Check is done before connecting; a store failure does not block the account
+func (qa *quotaAccount) Check() error {
+	if qa == nil {
+		return nil
+	}
+
+	now := time.Now()
+	used, err := qa.store.Get(qa.user, periodKey(qa.quota.period, now))
+	if err != nil {
+		util.Errorf("usage store: %v", err)
+		return nil
+	}
+
+	if qa.report(used) != nil {
+		return qa.exhaustedErr(now)
+	}
+	return nil
+}
+
+// Use accounts n bytes and returns errQuotaExhausted when there is no quota left
+func (qa *quotaAccount) Use(n int) error {
+	if qa == nil || n <= 0 {
+		return nil
+	}
+
+	used, err := qa.store.Add(qa.user, periodKey(qa.quota.period, time.Now()), int64(n))
+	if err != nil {
+		util.Errorf("usage store: %v", err)
+		return nil
+	}
+
+	return qa.report(used)
+}
+
+var quotaRemainingBytes = util.NewGaugeVecMetric(
+	"quota_remaining_bytes",
+	"Remaining traffic quota of accounts in the current period",
+	[]string{"name"},
+)
+
+// quotaReader accounts what has been read; the bytes which exhausted the quota
+// still pass, the tunnel ends after them
+type quotaReader struct {
+	r     io.Reader
+	quota *quotaAccount
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	if qErr := qr.quota.Use(n); qErr != nil && err == nil {
+		err = qErr
+	}
+	return n, err
+}
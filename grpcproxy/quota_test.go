@@ -0,0 +1,79 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaPeriods(t *testing.T) {
+	now := time.Date(2024, 12, 31, 23, 0, 0, 0, time.UTC)
+
+	require.Equal(t, "2024-12-31", periodKey(quotaPeriodDay, now))
+	require.Equal(t, "2024-12", periodKey(quotaPeriodMonth, now))
+	require.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), periodEnd(quotaPeriodDay, now))
+	require.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), periodEnd(quotaPeriodMonth, now))
+
+	_, err := NewQuotas([]AuthItem{{Name: "user", Quota: 1, QuotaPeriod: "week"}}, NewMemoryUsageStore())
+	require.Error(t, err)
+}
+
+func TestFileUsageStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	store, err := NewFileUsageStore(path, time.Hour)
+	require.NoError(t, err)
+	total, err := store.Add("user", "2024-06", 100)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, total)
+	require.NoError(t, store.Close())
+
+	// usage survives restarts
+	store, err = NewFileUsageStore(path, time.Hour)
+	require.NoError(t, err)
+	defer store.Close()
+	total, err = store.Add("user", "2024-06", 50)
+	require.NoError(t, err)
+	require.EqualValues(t, 150, total)
+
+	// past periods are dropped
+	total, err = store.Add("user", "2024-07", 10)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, total)
+	require.Equal(t, map[string]int64{"2024-07": 10}, store.usage["user"])
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	const quota = 64 * 1024
+	cfg := makeTestServerConfig(t)
+	var err error
+	cfg.Quotas, err = NewQuotas([]AuthItem{{Name: "anonymous", Quota: quota}}, NewMemoryUsageStore())
+	require.NoError(t, err)
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+	// the tunnel ends once the quota is used up
+	conn := dialCONNECT(t, proxyURL, echoAddr)
+	defer conn.Close()
+	go conn.Write(bytes.Repeat([]byte("x"), 2*quota))
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Less(t, len(b), 2*quota)
+
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	resp, err := client.Get("http://" + echoAddr)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Contains(t, string(body), "quota")
+}
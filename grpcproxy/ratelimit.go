@@ -0,0 +1,240 @@
+package grpcproxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RateLimiter is a token bucket for bytes; a big read may take more tokens
+// than there are, and then the reader waits till the debt is paid off
+type RateLimiter struct {
+	name      string
+	direction string
+
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// minimal burst to let io.Copy() chunks through without extra waits
+const minRateLimitBurst = 64 * 1024
+
+func NewRateLimiter(name, direction string, rate int64) *RateLimiter {
+	burst := max(float64(rate), minRateLimitBurst)
+	return &RateLimiter{
+		name:      name,
+		direction: direction,
+		rate:      float64(rate),
+		burst:     burst,
+		tokens:    burst,
+		last:      time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long to wait for them
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// refund gives back the tokens of the wait not done
+func (l *RateLimiter) refund(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.burst, l.tokens+d.Seconds()*l.rate)
+}
+
+var errRateLimitWaitCanceled = errors.New("rate limit wait is canceled")
+
+// Wait blocks until n bytes may pass or done is closed, nil limiter never waits;
+// on done the rest of the wait is refunded, so that a closed tunnel' debt
+// does not stall the other tunnels of a shared limiter
+func (l *RateLimiter) Wait(done <-chan struct{}, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-timer.C:
+	case <-done:
+		l.refund(d - time.Since(start))
+		err = errRateLimitWaitCanceled
+	}
+	throttledSeconds.With(prometheus.Labels{"name": l.name, "direction": l.direction}).Add(time.Since(start).Seconds())
+	return err
+}
+
+var throttledSeconds = util.NewCounterVecMetric(
+	"throttled_seconds_total",
+	"Time tunnels have been waiting for rate limits, by account (or global) and direction",
+	[]string{"name", "direction"},
+)
+
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+	done     <-chan struct{}
+}
+
+func (t *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	for _, l := range t.limiters {
+		if waitErr := l.Wait(t.done, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters []*RateLimiter
+	done     <-chan struct{}
+}
+
+func (t *rateLimitedWriter) Write(p []byte) (int, error) {
+	for _, l := range t.limiters {
+		if err := l.Wait(t.done, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return t.w.Write(p)
+}
+
+// newRateLimitedWriter limits w till done is closed
+func newRateLimitedWriter(w io.Writer, limiters []*RateLimiter, done <-chan struct{}) io.Writer {
+	if len(limiters) == 0 {
+		return w
+	}
+	return &rateLimitedWriter{w, limiters, done}
+}
+
+// newRateLimitedReader limits r till done is closed
+func newRateLimitedReader(r io.Reader, limiters []*RateLimiter, done <-chan struct{}) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &rateLimitedReader{r, limiters, done}
+}
+
+const (
+	directionUp   = "up"   // client -> destination
+	directionDown = "down" // destination -> client
+)
+
+type upDownLimiters struct {
+	up, down *RateLimiter
+}
+
+func newUpDownLimiters(name string, rate int64) upDownLimiters {
+	return upDownLimiters{
+		up:   NewRateLimiter(name, directionUp, rate),
+		down: NewRateLimiter(name, directionDown, rate),
+	}
+}
+
+// RateLimits are bandwidth limits of an instance (pog server or client):
+// the global one and per account ones, each direction is limited separately
+type RateLimits struct {
+	global   *upDownLimiters
+	accounts map[string]upDownLimiters
+}
+
+const globalRateLimitName = "global"
+
+// NewRateLimits makes limits out of globalRate and AuthItem.RateLimit values
+// (bytes per second, 0 means unlimited)
+func NewRateLimits(globalRate int64, authLst []AuthItem) *RateLimits {
+	rl := &RateLimits{
+		accounts: map[string]upDownLimiters{},
+	}
+
+	if globalRate > 0 {
+		global := newUpDownLimiters(globalRateLimitName, globalRate)
+		rl.global = &global
+	}
+
+	for _, ai := range authLst {
+		if ai.RateLimit > 0 {
+			rl.accounts[ai.Name] = newUpDownLimiters(ai.Name, ai.RateLimit)
+		}
+	}
+
+	return rl
+}
+
+// ForUser returns limiters for a tunnel of user, by direction
+func (rl *RateLimits) ForUser(user string) (up []*RateLimiter, down []*RateLimiter) {
+	if rl == nil {
+		return nil, nil
+	}
+
+	if l, ok := rl.accounts[user]; ok {
+		up = append(up, l.up)
+		down = append(down, l.down)
+	}
+	if rl.global != nil {
+		up = append(up, rl.global.up)
+		down = append(down, rl.global.down)
+	}
+
+	return up, down
+}
+
+// tunnelLimits are rate limiters and the quota of a tunnel, see handleBinaryTunneling()
+type tunnelLimits struct {
+	FromConn []*RateLimiter
+	ToConn   []*RateLimiter
+
+	Quota *quotaAccount
+}
+
+// wrapReader limits r with limiters and the quota, done is closed on the tunnel teardown
+func (tl tunnelLimits) wrapReader(r io.Reader, limiters []*RateLimiter, done <-chan struct{}) io.Reader {
+	r = newRateLimitedReader(r, limiters, done)
+	if tl.Quota != nil {
+		r = &quotaReader{r, tl.Quota}
+	}
+	return r
+}
+
+// clientTunnelLimits: the user conn is the upload side
+func (rl *RateLimits) clientTunnelLimits(user string) tunnelLimits {
+	up, down := rl.ForUser(user)
+	return tunnelLimits{FromConn: up, ToConn: down}
+}
+
+// serverTunnelLimits: the destination conn is the download side
+func (rl *RateLimits) serverTunnelLimits(user string) tunnelLimits {
+	up, down := rl.ForUser(user)
+	return tunnelLimits{FromConn: down, ToConn: up}
+}
@@ -0,0 +1,98 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter("test", directionUp, 1024*1024)
+
+	// the burst passes at once
+	require.Zero(t, l.reserve(1024*1024))
+
+	// then the debt is paid off at the rate
+	d := l.reserve(512 * 1024)
+	require.InDelta(t, 500*time.Millisecond, d, float64(50*time.Millisecond))
+
+	rl := NewRateLimits(0, []AuthItem{{Name: "limited", RateLimit: 1024}})
+	up, down := rl.ForUser("limited")
+	require.Len(t, up, 1)
+	require.Len(t, down, 1)
+	up, down = rl.ForUser("other")
+	require.Empty(t, up)
+	require.Empty(t, down)
+
+	var nilRL *RateLimits
+	up, _ = nilRL.ForUser("limited")
+	require.Empty(t, up)
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	l := NewRateLimiter("test", directionUp, 1024*1024)
+	require.Zero(t, l.reserve(1024*1024))
+
+	// a closed tunnel stops waiting and gives its debt back
+	done := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	start := time.Now()
+	require.ErrorIs(t, l.Wait(done, 10*1024*1024), errRateLimitWaitCanceled)
+	require.Less(t, time.Since(start), time.Second)
+
+	d := l.reserve(512 * 1024)
+	require.Less(t, d, time.Second)
+}
+
+func TestRateLimitedTunnel(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	const rate = 64 * 1024
+	cfg := makeTestServerConfig(t)
+	cfg.RateLimits = NewRateLimits(rate, nil)
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+	conn := dialCONNECT(t, proxyURL, echoAddr)
+	defer conn.Close()
+
+	// the burst plus a second worth of data
+	data := bytes.Repeat([]byte("x"), minRateLimitBurst+rate)
+
+	start := time.Now()
+	go conn.Write(data)
+
+	b := make([]byte, len(data))
+	_, err := io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestRateLimitedHTTPForwarding(t *testing.T) {
+	const rate = 64 * 1024
+	data := bytes.Repeat([]byte("x"), minRateLimitBurst+rate)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer backend.Close()
+
+	proxyURL, pcc := startLocalPOG(t)
+	pcc.RateLimits = NewRateLimits(rate, nil)
+
+	start := time.Now()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
@@ -0,0 +1,351 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver is the pog server' own DNS resolver instead of the system one:
+// upstreams are tried in order till one answers, answers are cached for their
+// TTL, NXDOMAIN and empty answers are cached too (negative caching, RFC 2308)
+type Resolver struct {
+	upstreams   []dnsUpstream
+	preferIPv6  bool
+	timeout     time.Duration
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[dnsCacheKey]dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+const dnsCacheMaxSize = 10000
+
+// NewResolver makes a resolver out of upstreams, see parseDNSUpstream();
+// prefer is "ipv4" (the default) or "ipv6", the family to be dialed first
+func NewResolver(upstreams []string, prefer string, timeout, negativeTTL time.Duration) (*Resolver, error) {
+	r := &Resolver{
+		timeout:     timeout,
+		negativeTTL: negativeTTL,
+		cache:       map[dnsCacheKey]dnsCacheEntry{},
+	}
+
+	switch prefer {
+	case "", "ipv4":
+	case "ipv6":
+		r.preferIPv6 = true
+	default:
+		return nil, fmt.Errorf("bad DNS family preference %q, must be ipv4 or ipv6", prefer)
+	}
+
+	for _, s := range upstreams {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		u, err := parseDNSUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	if len(r.upstreams) == 0 {
+		return nil, errors.New("no DNS upstreams")
+	}
+
+	return r, nil
+}
+
+var (
+	dnsResolutionSeconds = util.NewSummaryVecWithObjectivesMetric(
+		"dns_resolution_seconds",
+		"DNS query time, by upstream",
+		[]string{"upstream"},
+		util.MakeDefaultObjectives(),
+	)
+
+	dnsFailuresCnt = util.MakeCounterVecFunc(
+		"dns_failures_total",
+		"Number of failed DNS queries, by upstream",
+	)
+
+	dnsCacheCnt = util.MakeCounterVecFunc(
+		"dns_cache_total",
+		"Number of DNS cache lookups, by result (hit, miss)",
+	)
+)
+
+// LookupIP returns IPv4 and IPv6 addresses of host, the preferred family first
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	if r.preferIPv6 {
+		qtypes[0], qtypes[1] = qtypes[1], qtypes[0]
+	}
+
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+
+			ips, err := r.lookup(ctx, name, qtype)
+			results[i] = result{ips, err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	for _, res := range results {
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+
+	for _, res := range results {
+		if res.err != nil {
+			return nil, res.err
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *Resolver) cached(key dnsCacheKey) (dnsCacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return entry, false
+	}
+	return entry, ok
+}
+
+func (r *Resolver) store(key dnsCacheKey, entry dnsCacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= dnsCacheMaxSize {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		// still full: drop some entries, map order is random enough
+		for k := range r.cache {
+			if len(r.cache) < dnsCacheMaxSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+
+	r.cache[key] = entry
+}
+
+func (r *Resolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := dnsCacheKey{name, qtype}
+	if entry, ok := r.cached(key); ok {
+		dnsCacheCnt("hit", 1)
+		return entry.ips, entry.err
+	}
+	dnsCacheCnt("miss", 1)
+
+	ips, ttl, err := r.query(ctx, name, qtype)
+	if ttl > 0 {
+		r.store(key, dnsCacheEntry{ips, err, time.Now().Add(ttl)})
+	}
+	return ips, err
+}
+
+// query asks upstreams in order; ttl is how long the answer may be cached, 0 for failures
+func (r *Resolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	dnsName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	id := newDNSQueryID()
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsName,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, u := range r.upstreams {
+		uctx, cancel := context.WithTimeout(ctx, r.timeout)
+		start := time.Now()
+		resp, err := u.exchange(uctx, query)
+		cancel()
+		dnsResolutionSeconds.WithLabelValues(u.String()).Observe(time.Since(start).Seconds())
+
+		var ans dnsAnswer
+		if err == nil {
+			ans, err = parseDNSAnswer(resp, id, qtype)
+		}
+		if err == nil && ans.rcode != dnsmessage.RCodeSuccess && ans.rcode != dnsmessage.RCodeNameError {
+			err = fmt.Errorf("server failure: %v", ans.rcode)
+		}
+		if err != nil {
+			util.Debugf("dns: %s %v via %s failed: %v", name, qtype, u, err)
+			dnsFailuresCnt(u.String(), 1)
+			lastErr = err
+			continue
+		}
+
+		if len(ans.ips) > 0 {
+			return ans.ips, ans.ttl, nil
+		}
+
+		negativeTTL := r.negativeTTL
+		if ans.ttl > 0 {
+			negativeTTL = min(negativeTTL, ans.ttl)
+		}
+		if ans.rcode == dnsmessage.RCodeNameError {
+			return nil, negativeTTL, &net.DNSError{Err: "no such host", Name: strings.TrimSuffix(name, "."), IsNotFound: true}
+		}
+		// no records of the type
+		return nil, negativeTTL, nil
+	}
+
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: strings.TrimSuffix(name, "."), IsTemporary: true}
+}
+
+// newDNSQueryID is unpredictable, so that off-path answers are hard to forge
+func newDNSQueryID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+type dnsAnswer struct {
+	rcode dnsmessage.RCode
+	ips   []net.IP
+	ttl   time.Duration // min TTL of the records or of SOA for negative answers
+}
+
+func parseDNSAnswer(resp []byte, id uint16, qtype dnsmessage.Type) (dnsAnswer, error) {
+	var ans dnsAnswer
+	var p dnsmessage.Parser
+	hdr, err := p.Start(resp)
+	if err != nil {
+		return ans, err
+	}
+	if !hdr.Response || hdr.ID != id {
+		return ans, errors.New("unexpected DNS response")
+	}
+	ans.rcode = hdr.RCode
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return ans, err
+	}
+
+	var ttl uint32
+	setTTL := func(t uint32) {
+		if ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return ans, err
+		}
+
+		switch {
+		case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return ans, err
+			}
+			ans.ips = append(ans.ips, net.IP(r.A[:]))
+			setTTL(h.TTL)
+		case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return ans, err
+			}
+			ans.ips = append(ans.ips, net.IP(r.AAAA[:]))
+			setTTL(h.TTL)
+		default:
+			// CNAMEs and the like: the addresses follow them
+			if err := p.SkipAnswer(); err != nil {
+				return ans, err
+			}
+		}
+	}
+
+	if len(ans.ips) == 0 {
+		// RFC 2308: negative answers live for min(SOA TTL, SOA MINIMUM)
+		for {
+			h, err := p.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if h.Type != dnsmessage.TypeSOA {
+				if err := p.SkipAuthority(); err != nil {
+					break
+				}
+				continue
+			}
+
+			soa, err := p.SOAResource()
+			if err != nil {
+				break
+			}
+			setTTL(min(h.TTL, soa.MinTTL))
+			break
+		}
+	}
+
+	ans.ttl = time.Duration(ttl) * time.Second
+	return ans, nil
+}
@@ -0,0 +1,177 @@
+package grpcproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNSAnswer knows echo.test (127.0.0.1) and v6.test (::1), other names are NXDOMAIN
+func stubDNSAnswer(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	q := msg.Questions[0]
+
+	msg.Header.Response = true
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	switch {
+	case q.Name.String() == "echo.test." && q.Type == dnsmessage.TypeA:
+		msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}}}
+	case q.Name.String() == "v6.test." && q.Type == dnsmessage.TypeAAAA:
+		msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}}}}
+	case q.Name.String() == "echo.test.", q.Name.String() == "v6.test.":
+		// no records of the type
+	default:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("admin.test."),
+				MinTTL: 5,
+			},
+		}}
+	}
+
+	resp, err := msg.Pack()
+	require.NoError(t, err)
+	return resp
+}
+
+// startStubDNS runs a plain DNS server over UDP, returns its address and the query counter
+func startStubDNS(t *testing.T) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			conn.WriteTo(stubDNSAnswer(t, buf[:n]), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String(), &queries
+}
+
+func TestResolver(t *testing.T) {
+	addr, queries := startStubDNS(t)
+
+	// the first upstream is dead
+	r, err := NewResolver([]string{"127.0.0.1:1", addr}, "ipv4", time.Second, time.Minute)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	ips, err := r.LookupIP(ctx, "echo.test")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	require.Equal(t, "127.0.0.1", ips[0].String())
+	require.EqualValues(t, 2, queries.Load())
+
+	// both A and AAAA answers are cached
+	_, err = r.LookupIP(ctx, "ECHO.test")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, queries.Load())
+
+	ips, err = r.LookupIP(ctx, "v6.test")
+	require.NoError(t, err)
+	require.Equal(t, "::1", ips[0].String())
+
+	// negative caching, for min(DNS_NEGATIVE_TTL, SOA MINIMUM)
+	queries.Store(0)
+	for range [2]struct{}{} {
+		_, err = r.LookupIP(ctx, "unknown.test")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		require.True(t, dnsErr.IsNotFound)
+	}
+	require.EqualValues(t, 2, queries.Load())
+
+	entry, ok := r.cached(dnsCacheKey{"unknown.test.", dnsmessage.TypeA})
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(5*time.Second), entry.expires, time.Second)
+
+	_, err = NewResolver([]string{"ftp://1.1.1.1"}, "", time.Second, time.Minute)
+	require.Error(t, err)
+}
+
+func TestResolverSpoofedAnswer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	spoofConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer spoofConn.Close()
+
+	// answers come from another address than the one asked
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			spoofConn.WriteTo(stubDNSAnswer(t, buf[:n]), addr)
+		}
+	}()
+
+	r, err := NewResolver([]string{conn.LocalAddr().String()}, "ipv4", 200*time.Millisecond, time.Minute)
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "echo.test")
+	require.Error(t, err)
+}
+
+func TestResolverDoH(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, dnsMessageContentType, r.Header.Get("Content-Type"))
+		query, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(stubDNSAnswer(t, query))
+	}))
+	defer srv.Close()
+
+	r := &Resolver{
+		upstreams:   []dnsUpstream{&dohUpstream{url: srv.URL, client: srv.Client()}},
+		timeout:     time.Second,
+		negativeTTL: time.Minute,
+		cache:       map[dnsCacheKey]dnsCacheEntry{},
+	}
+
+	ips, err := r.LookupIP(context.Background(), "echo.test")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", ips[0].String())
+}
+
+func TestResolverDial(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, port, err := splitHostPort(echoAddr)
+	require.NoError(t, err)
+
+	dnsAddr, _ := startStubDNS(t)
+	cfg := makeTestServerConfig(t)
+	cfg.Resolver, err = NewResolver([]string{dnsAddr}, "", time.Second, time.Minute)
+	require.NoError(t, err)
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+
+	// echo.test is known to our resolver only
+	conn := dialCONNECT(t, proxyURL, net.JoinHostPort("echo.test", strconv.Itoa(port)))
+	defer conn.Close()
+	requireEcho(t, conn)
+}
@@ -0,0 +1,487 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReverseListeners are reverse tunnels (server side): a pog client registers
+// a listener with the Listen RPC, and the server streams every inbound connection
+// back to the client:
+//   - a listener is a dedicated TCP port, or a host name which connections to
+//     the shared REVERSE_LISTEN address are routed by (TLS SNI or HTTP Host)
+//   - an account may register listeners matching its patterns, AuthItem.Reverse or
+//     REVERSE_ALLOW: "9000" (port), "dev.example.com" (name), "*.example.com",
+//     "*" (anything)
+//   - an inbound connection not picked up within reversePickupTimeout is dropped,
+//     as well as one the client is too busy to be told about
+type ReverseListeners struct {
+	allow    []string
+	accounts map[string][]string
+
+	bindHost string
+	shared   net.Listener // nil if no REVERSE_LISTEN
+
+	mu      sync.Mutex
+	byName  map[string]*reverseListener
+	pending map[uint64]*inboundConn
+	lastID  uint64
+}
+
+const reversePickupTimeout = 10 * time.Second
+
+type reverseListener struct {
+	label string // name or :port
+	user  string
+
+	events chan *pb.InboundConnection
+}
+
+type inboundConn struct {
+	conn     net.Conn
+	listener *reverseListener
+}
+
+var reverseConnections = util.MakeCounterVecFunc(
+	"reverse_connections_total",
+	"Number of inbound connections of reverse tunnels, by result: accepted, unrouted, dropped",
+)
+
+// NewReverseListeners returns nil if no account may register listeners;
+// sharedAddr is the address of the listener routed by host names, if any
+func NewReverseListeners(allow []string, authLst []AuthItem, sharedAddr, bindHost string) (*ReverseListeners, error) {
+	rl := &ReverseListeners{
+		accounts: map[string][]string{},
+		bindHost: bindHost,
+		byName:   map[string]*reverseListener{},
+		pending:  map[uint64]*inboundConn{},
+	}
+
+	for _, p := range allow {
+		if p = strings.TrimSpace(p); p != "" {
+			rl.allow = append(rl.allow, p)
+		}
+	}
+	for _, item := range authLst {
+		if len(item.Reverse) > 0 {
+			rl.accounts[item.Name] = item.Reverse
+		}
+	}
+	if len(rl.allow) == 0 && len(rl.accounts) == 0 {
+		return nil, nil
+	}
+
+	if sharedAddr != "" {
+		l, err := net.Listen("tcp", sharedAddr)
+		if err != nil {
+			err = fmt.Errorf("reverse listener %s: %v", sharedAddr, err)
+			util.Error(err)
+			return nil, err
+		}
+		rl.shared = l
+		util.Infof("reverse tunnels listening address %s", l.Addr())
+
+		go rl.serveShared()
+	}
+
+	return rl, nil
+}
+
+// SharedAddr is the address of the listener routed by host names, nil if none
+func (rl *ReverseListeners) SharedAddr() net.Addr {
+	if rl == nil || rl.shared == nil {
+		return nil
+	}
+	return rl.shared.Addr()
+}
+
+func (rl *ReverseListeners) Close() {
+	if rl == nil || rl.shared == nil {
+		return
+	}
+	rl.shared.Close()
+}
+
+func matchReversePattern(pattern string, req *pb.ListenRequest) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if req.Port != 0 {
+		return pattern == strconv.Itoa(int(req.Port))
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(req.Name, "."+suffix)
+	}
+	return pattern == req.Name
+}
+
+func (rl *ReverseListeners) authorize(user string, req *pb.ListenRequest) error {
+	if rl == nil {
+		return status.Error(codes.PermissionDenied, "reverse tunnels are disabled")
+	}
+
+	patterns, ok := rl.accounts[user]
+	if !ok {
+		patterns = rl.allow
+	}
+	for _, p := range patterns {
+		if matchReversePattern(p, req) {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.PermissionDenied, "reverse listener %s is not allowed for %s", reverseLabel(req), user)
+}
+
+func reverseLabel(req *pb.ListenRequest) string {
+	if req.Port != 0 {
+		return ":" + strconv.Itoa(int(req.Port))
+	}
+	return req.Name
+}
+
+// register starts a listener for req, unregister() is to be called when
+// the Listen call is over
+func (rl *ReverseListeners) register(user string, req *pb.ListenRequest) (l *reverseListener, addr string, unregister func(), err error) {
+	req.Name = strings.ToLower(req.Name)
+	if (req.Name == "") == (req.Port == 0) {
+		return nil, "", nil, status.Error(codes.InvalidArgument, "either name or port is to be set")
+	}
+	if err := rl.authorize(user, req); err != nil {
+		return nil, "", nil, err
+	}
+
+	l = &reverseListener{
+		label:  reverseLabel(req),
+		user:   user,
+		events: make(chan *pb.InboundConnection, 64),
+	}
+
+	if req.Port != 0 {
+		tcpListener, err := net.Listen("tcp", net.JoinHostPort(rl.bindHost, strconv.Itoa(int(req.Port))))
+		if err != nil {
+			return nil, "", nil, status.Error(codes.Unavailable, err.Error())
+		}
+		go func() {
+			for {
+				conn, err := tcpListener.Accept()
+				if err != nil {
+					return
+				}
+				rl.offer(l, conn)
+			}
+		}()
+
+		return l, tcpListener.Addr().String(), func() {
+			tcpListener.Close()
+		}, nil
+	}
+
+	if rl.shared == nil {
+		return nil, "", nil, status.Error(codes.FailedPrecondition, "no REVERSE_LISTEN for named reverse listeners")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.byName[req.Name]; ok {
+		return nil, "", nil, status.Errorf(codes.AlreadyExists, "reverse listener %s is registered already", req.Name)
+	}
+	rl.byName[req.Name] = l
+
+	return l, rl.shared.Addr().String(), func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		delete(rl.byName, req.Name)
+	}, nil
+}
+
+func (rl *ReverseListeners) serveShared() {
+	for {
+		conn, err := rl.shared.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			name, conn, err := sniffServerName(conn, sniffTimeout)
+			if err != nil {
+				util.Debugf("reverse connection from %s: %v", conn.RemoteAddr(), err)
+				reverseConnections("unrouted", 1)
+				conn.Close()
+				return
+			}
+
+			rl.mu.Lock()
+			l, ok := rl.byName[name]
+			rl.mu.Unlock()
+			if !ok {
+				util.Debugf("reverse connection from %s: no listener %s", conn.RemoteAddr(), name)
+				reverseConnections("unrouted", 1)
+				conn.Close()
+				return
+			}
+
+			rl.offer(l, conn)
+		}()
+	}
+}
+
+// offer announces conn to the listener' client and waits for it to be picked up
+func (rl *ReverseListeners) offer(l *reverseListener, conn net.Conn) {
+	rl.mu.Lock()
+	rl.lastID++
+	id := rl.lastID
+	rl.pending[id] = &inboundConn{conn: conn, listener: l}
+	rl.mu.Unlock()
+
+	select {
+	case l.events <- &pb.InboundConnection{Id: id, RemoteAddr: conn.RemoteAddr().String()}:
+	default:
+		// the client does not keep up, nobody would claim the connection
+		rl.mu.Lock()
+		delete(rl.pending, id)
+		rl.mu.Unlock()
+
+		util.Debugf("reverse connection from %s: listener %s is busy", conn.RemoteAddr(), l.label)
+		reverseConnections("dropped", 1)
+		conn.Close()
+		return
+	}
+
+	time.AfterFunc(reversePickupTimeout, func() {
+		rl.mu.Lock()
+		ic, ok := rl.pending[id]
+		delete(rl.pending, id)
+		rl.mu.Unlock()
+
+		if ok {
+			reverseConnections("dropped", 1)
+			ic.conn.Close()
+		}
+	})
+}
+
+// claim hands the inbound connection over to a ReverseAcceptRequest stream
+func (rl *ReverseListeners) claim(user string, id uint64) (*inboundConn, error) {
+	if rl == nil {
+		return nil, status.Error(codes.PermissionDenied, "reverse tunnels are disabled")
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	ic, ok := rl.pending[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no inbound connection %d", id)
+	}
+	if ic.listener.user != user {
+		return nil, status.Errorf(codes.PermissionDenied, "inbound connection %d is not for %s", id, user)
+	}
+	delete(rl.pending, id)
+
+	reverseConnections("accepted", 1)
+	return ic, nil
+}
+
+func (s *httpProxyServer) Listen(req *pb.ListenRequest, stream pb.HTTPProxy_ListenServer) error {
+	user := "anonymous"
+	if ca, ok := stream.Context().Value(connectionAuthKey{}).(ConnectionAuthCtx); ok {
+		user = ca.User
+	}
+
+	l, addr, unregister, err := s.cfg.Reverse.register(user, req)
+	if err != nil {
+		util.Infof("reverse listener %s of %s: %v", reverseLabel(req), user, err)
+		return err
+	}
+	defer unregister()
+	util.Infof("reverse listener %s of %s is registered", l.label, user)
+	defer util.Infof("reverse listener %s of %s is over", l.label, user)
+
+	err = stream.Send(&pb.ListenEvent{
+		Union: &pb.ListenEvent_Ready{Ready: &pb.ListenReady{Address: addr}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev := <-l.events:
+			err := stream.Send(&pb.ListenEvent{
+				Union: &pb.ListenEvent_Inbound{Inbound: ev},
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// ReverseTunnel is a reverse listener to keep registered on the pog server,
+// with the local address its inbound connections go to (client side)
+type ReverseTunnel struct {
+	Name   string // or Port, see ListenRequest
+	Port   int
+	Target string // host:port
+}
+
+func (rt ReverseTunnel) label() string {
+	return reverseLabel(&pb.ListenRequest{Name: rt.Name, Port: uint32(rt.Port)})
+}
+
+// ParseReverseTunnels parses a comma-separated list of remote=target items,
+// remote is a host name or :port, e.g. "dev.example.com=localhost:3000,:2222=localhost:22"
+func ParseReverseTunnels(s string) ([]ReverseTunnel, error) {
+	var lst []ReverseTunnel
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		remote, target, ok := strings.Cut(item, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("reverse tunnel %q: remote=target expected", item)
+		}
+
+		rt := ReverseTunnel{Target: target}
+		if port, ok := strings.CutPrefix(remote, ":"); ok {
+			n, err := strconv.Atoi(port)
+			if err != nil || n <= 0 || n > 65535 {
+				return nil, fmt.Errorf("reverse tunnel %q: bad port %q", item, port)
+			}
+			rt.Port = n
+		} else {
+			rt.Name = remote
+		}
+		lst = append(lst, rt)
+	}
+	return lst, nil
+}
+
+const (
+	reverseMinBackoff = time.Second
+	reverseMaxBackoff = 30 * time.Second
+)
+
+// ServeReverse keeps the reverse listener registered till ctx is done
+func ServeReverse(ctx context.Context, pcc *ProxyClientContext, rt ReverseTunnel) {
+	backoff := reverseMinBackoff
+	for {
+		registered, err := serveReverseOnce(ctx, pcc, rt)
+		if ctx.Err() != nil {
+			return
+		}
+		if registered {
+			backoff = reverseMinBackoff
+		}
+		util.Errorf("reverse listener %s: %v, retrying in %v", rt.label(), err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, reverseMaxBackoff)
+	}
+}
+
+// reverseServer is the pog server to register reverse listeners on,
+// accepts are to go to the same server
+func (pcc *ProxyClientContext) reverseServer() (pb.HTTPProxyClient, streamOpener) {
+	if pcc.Pool != nil {
+		ps := pcc.Pool.order()[0]
+		return ps.client, ps
+	}
+	return pcc.Client, pcc
+}
+
+func serveReverseOnce(ctx context.Context, pcc *ProxyClientContext, rt ReverseTunnel) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client, opener := pcc.reverseServer()
+	listen, err := client.Listen(ctx, &pb.ListenRequest{Name: rt.Name, Port: uint32(rt.Port)})
+	if err != nil {
+		return false, err
+	}
+
+	ev, err := listen.Recv()
+	if err != nil {
+		return false, err
+	}
+	ready := ev.GetReady()
+	if ready == nil {
+		return false, fmt.Errorf("got %+v instead of ListenReady", ev.Union)
+	}
+	util.Infof("reverse listener %s is registered at %s, target %s", rt.label(), ready.Address, rt.Target)
+
+	for {
+		ev, err := listen.Recv()
+		if err != nil {
+			return true, err
+		}
+
+		if inbound := ev.GetInbound(); inbound != nil {
+			go acceptReverse(ctx, pcc, opener, rt, inbound)
+		}
+	}
+}
+
+func acceptReverse(ctx context.Context, pcc *ProxyClientContext, opener streamOpener, rt ReverseTunnel, inbound *pb.InboundConnection) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: rt.Target,
+			User:        "-",
+			RemoteAddr:  inbound.RemoteAddr,
+			Code:        strconv.Itoa(code),
+			Proto:       "REVERSE",
+		})
+	}
+
+	packet := &pb.Packet{
+		Union: &pb.Packet_ReverseAcceptRequest{
+			ReverseAcceptRequest: &pb.ReverseAcceptRequest{
+				Id: inbound.Id,
+			},
+		},
+	}
+	stream, err := openStreamVia(ctx, opener, packet)
+	if err != nil {
+		util.Errorf("reverse connection %s: %v", inbound.RemoteAddr, err)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+
+	dialer := net.Dialer{Timeout: destDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", rt.Target)
+	if err != nil {
+		util.Errorf("reverse connection %s: %v", inbound.RemoteAddr, err)
+		logReq(http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	logReq(http.StatusOK)
+
+	handleBinaryTunneling(stream, conn, cancel, pcc.RateLimits.clientTunnelLimits(""))
+}
@@ -0,0 +1,195 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func startReversePOG(t *testing.T) (*ReverseListeners, *ProxyClientContext) {
+	reverse, err := NewReverseListeners([]string{"*"}, nil, "127.0.0.1:0", "127.0.0.1")
+	require.NoError(t, err)
+	t.Cleanup(reverse.Close)
+
+	cfg := makeTestServerConfig(t)
+	cfg.Reverse = reverse
+	_, pcc := startLocalPOGWithConfig(t, cfg)
+
+	return reverse, pcc
+}
+
+func serveReverse(t *testing.T, pcc *ProxyClientContext, rt ReverseTunnel) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ServeReverse(ctx, pcc, rt)
+}
+
+func TestReverseTunnelPort(t *testing.T) {
+	target := grpctest.NewLocalListener()
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "hello from target")
+			conn.Close()
+		}
+	}()
+
+	l := grpctest.NewLocalListener()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	_, pcc := startReversePOG(t)
+	serveReverse(t, pcc, ReverseTunnel{Port: port, Target: target.Addr().String()})
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+
+		b, _ := io.ReadAll(conn)
+		return string(b) == "hello from target"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestReverseTunnelNamed(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer secure.Close()
+
+	reverse, pcc := startReversePOG(t)
+	serveReverse(t, pcc, ReverseTunnel{Name: "plain.test", Target: plain.Listener.Addr().String()})
+	serveReverse(t, pcc, ReverseTunnel{Name: "secure.test", Target: secure.Listener.Addr().String()})
+
+	sharedAddr := reverse.SharedAddr().String()
+	get := func(schema, host string) (string, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+			},
+			Timeout: 5 * time.Second,
+		}
+		req, err := http.NewRequest(http.MethodGet, schema+"://"+sharedAddr+"/", nil)
+		require.NoError(t, err)
+		req.Host = host
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	// routed by Host
+	require.Eventually(t, func() bool {
+		body, _ := get("http", "plain.test")
+		return body == "plain"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// routed by SNI
+	require.Eventually(t, func() bool {
+		body, _ := get("https", "secure.test")
+		return body == "secure"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := get("http", "unknown.test")
+	require.Error(t, err)
+}
+
+func TestReverseListenersAuthorization(t *testing.T) {
+	authLst := []AuthItem{
+		{Name: "alice", Reverse: []string{"*.alice.test", "9000"}},
+		{Name: "bob"},
+	}
+	reverse, err := NewReverseListeners(nil, authLst, "127.0.0.1:0", "127.0.0.1")
+	require.NoError(t, err)
+	defer reverse.Close()
+
+	register := func(user string, req *pb.ListenRequest) codes.Code {
+		_, _, unregister, err := reverse.register(user, req)
+		if err == nil {
+			t.Cleanup(unregister)
+		}
+		return status.Code(err)
+	}
+
+	require.Equal(t, codes.OK, register("alice", &pb.ListenRequest{Name: "Dev.Alice.test"}))
+	require.Equal(t, codes.AlreadyExists, register("alice", &pb.ListenRequest{Name: "dev.alice.test"}))
+	require.Equal(t, codes.PermissionDenied, register("alice", &pb.ListenRequest{Name: "dev.bob.test"}))
+	require.Equal(t, codes.PermissionDenied, register("alice", &pb.ListenRequest{Port: 9001}))
+	require.Equal(t, codes.PermissionDenied, register("bob", &pb.ListenRequest{Name: "bob.alice.test"}))
+	require.Equal(t, codes.InvalidArgument, register("alice", &pb.ListenRequest{}))
+
+	// inbound connections are for the listener' account only
+	l, _, unregister, err := reverse.register("alice", &pb.ListenRequest{Name: "api.alice.test"})
+	require.NoError(t, err)
+	defer unregister()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	reverse.offer(l, server)
+	id := (<-l.events).Id
+
+	_, err = reverse.claim("bob", id)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = reverse.claim("alice", id)
+	require.NoError(t, err)
+	_, err = reverse.claim("alice", id)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// a connection the client is not told about is dropped at once
+	busy := &reverseListener{label: "busy.alice.test", user: "alice", events: make(chan *pb.InboundConnection)}
+	client2, server2 := net.Pipe()
+	defer client2.Close()
+	reverse.offer(busy, server2)
+	_, err = client2.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	require.Empty(t, reverse.pending)
+
+	// no one may register listeners
+	reverse, err = NewReverseListeners(nil, []AuthItem{{Name: "bob"}}, "", "")
+	require.NoError(t, err)
+	require.Nil(t, reverse)
+	_, _, _, err = reverse.register("bob", &pb.ListenRequest{Port: 9000})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestParseReverseTunnels(t *testing.T) {
+	lst, err := ParseReverseTunnels("dev.example.com=localhost:3000, :2222=localhost:22")
+	require.NoError(t, err)
+	require.Equal(t, []ReverseTunnel{
+		{Name: "dev.example.com", Target: "localhost:3000"},
+		{Port: 2222, Target: "localhost:22"},
+	}, lst)
+
+	_, err = ParseReverseTunnels(":http=localhost:80")
+	require.Error(t, err)
+	_, err = ParseReverseTunnels("dev.example.com")
+	require.Error(t, err)
+}
@@ -15,18 +15,22 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func RegisterProxySvc(server *grpc.Server) {
-	svc := new(httpProxyServer)
+func RegisterProxySvc(server *grpc.Server, cfg ServerConfig) {
+	svc := &httpProxyServer{
+		cfg: cfg,
+	}
 	pb.RegisterHTTPProxyServer(server, svc)
 }
 
 type httpProxyServer struct {
+	cfg ServerConfig
+
 	pb.UnimplementedHTTPProxyServer
 }
 
 func (s *httpProxyServer) Run(stream pb.HTTPProxy_RunServer) error {
 	var statusErr error
-	doRun(stream, &statusErr)
+	s.doRun(stream, &statusErr)
 
 	return statusErr
 }
@@ -36,6 +40,11 @@ type LogRecord struct {
 	User        string
 	RemoteAddr  string
 	Code        string
+	Proto       string // HTTPS (CONNECT) if empty
+	Egress      string // local address the tunnel leaves from, if chosen by EgressSourcePolicy
+	NextHop     string // the next pog server the tunnel goes through, if any
+	Route       string // direct, pog, reject or fallback, if chosen by ClientRouter or FallbackPolicy
+	Server      string // the pog server name, if chosen by ServerRouter
 }
 
 var disableAccessLogging = os.Getenv("DISABLE_ACCESS_LOGGING") != ""
@@ -45,11 +54,27 @@ func logRequest(rec LogRecord) {
 		return
 	}
 
-	connectProto := "HTTPS"
-	fmt.Printf("pog: %s %s %s %v [%v] %v\n", rec.ConnectAddr, rec.User, connectProto, rec.RemoteAddr, time.Now().Format(time.RFC3339), rec.Code)
+	connectProto := rec.Proto
+	if connectProto == "" {
+		connectProto = "HTTPS"
+	}
+	extra := ""
+	if rec.Egress != "" {
+		extra += " egress=" + rec.Egress
+	}
+	if rec.NextHop != "" {
+		extra += " next_hop=" + rec.NextHop
+	}
+	if rec.Route != "" {
+		extra += " route=" + rec.Route
+	}
+	if rec.Server != "" {
+		extra += " server=" + rec.Server
+	}
+	fmt.Printf("pog: %s %s %s %v [%v] %v%s\n", rec.ConnectAddr, rec.User, connectProto, rec.RemoteAddr, time.Now().Format(time.RFC3339), rec.Code, extra)
 }
 
-func doRun(stream Stream, statusErr *error) {
+func (s *httpProxyServer) doRun(stream Stream, statusErr *error) {
 	user := "anonymous"
 	streamCtx := stream.(interface {
 		Context() context.Context
@@ -59,6 +84,9 @@ func doRun(stream Stream, statusErr *error) {
 	}
 
 	connectAddr := "-"
+	connectProto := ""
+	egressAddr := ""
+	nextHop := ""
 
 	logReq := func(code codes.Code) {
 		remoteAddr := "-"
@@ -71,6 +99,9 @@ func doRun(stream Stream, statusErr *error) {
 			User:        user,
 			RemoteAddr:  remoteAddr,
 			Code:        code.String(),
+			Proto:       connectProto,
+			Egress:      egressAddr,
+			NextHop:     nextHop,
 		})
 	}
 
@@ -85,13 +116,6 @@ func doRun(stream Stream, statusErr *error) {
 		return
 	}
 
-	req, err := castFromUnion[*pb.Packet_ConnectRequest](packet)
-	if err != nil {
-		bailOut(status.Error(codes.FailedPrecondition, err.Error()))
-		return
-	}
-	connectAddr = req.ConnectRequest.HostPort
-
 	sendConnectResponse := func(httpErr *pb.HTTPError) error {
 		packet = &pb.Packet{
 			Union: &pb.Packet_ConnectResponse{
@@ -107,16 +131,112 @@ func doRun(stream Stream, statusErr *error) {
 		return err
 	}
 
-	destConn, err := net.DialTimeout("tcp", req.ConnectRequest.HostPort, 10*time.Second)
-	if err != nil {
-		sendConnectResponse(&pb.HTTPError{
-			StatusCode: http.StatusServiceUnavailable,
-			Error:      err.Error(),
+	// admit checks the concurrent tunnels limits and the quota,
+	// release() frees the tunnel slot
+	quota := s.cfg.Quotas.ForUser(user)
+	var release func()
+	admit := func() bool {
+		var err error
+		release, err = s.cfg.TunnelCaps.Acquire(user, peerIP(streamCtx))
+		if err == nil {
+			if err = quota.Check(); err != nil {
+				release()
+			}
+		}
+
+		if err != nil {
+			sendConnectResponse(destinationHTTPError(err))
+			bailOut(err)
+			return false
+		}
+		return true
+	}
+
+	if _, ok := packet.Union.(*pb.Packet_UdpAssociateRequest); ok {
+		connectProto = "UDP"
+		if !admit() {
+			return
+		}
+		defer release()
+
+		src := s.cfg.EgressSource.PickDefault(user)
+		udpConns, err := listenUDP(src)
+		if err != nil {
+			sendConnectResponse(&pb.HTTPError{
+				StatusCode: http.StatusServiceUnavailable,
+				Error:      err.Error(),
+			})
+			bailOut(err)
+			return
+		}
+		defer udpConns.Close()
+		connectAddr = udpConns.String()
+		if src != nil {
+			egressAddr = udpConns.egressIPs()
+		}
+
+		if err := sendConnectResponse(nil); err != nil {
+			bailOut(err)
+			return
+		}
+		logReq(codes.OK)
+
+		relayUDP(stream, udpConns, s.cfg.UDPIdleTimeout, quota, func(hostPort string) (*net.UDPAddr, error) {
+			return s.resolveUDPDestination(streamCtx, user, hostPort, udpConns)
 		})
+		return
+	}
+
+	if req, ok := packet.Union.(*pb.Packet_ReverseAcceptRequest); ok {
+		connectProto = "REVERSE"
+		if !admit() {
+			return
+		}
+		defer release()
+
+		inbound, err := s.cfg.Reverse.claim(user, req.ReverseAcceptRequest.Id)
+		if err != nil {
+			sendConnectResponse(destinationHTTPError(err))
+			bailOut(err)
+			return
+		}
+		defer inbound.conn.Close()
+		connectAddr = inbound.listener.label
+
+		if err := sendConnectResponse(nil); err != nil {
+			bailOut(err)
+			return
+		}
+		logReq(codes.OK)
+
+		s.tunnel(stream, inbound.conn, user, quota)
+		return
+	}
+
+	req, err := castFromUnion[*pb.Packet_ConnectRequest](packet)
+	if err != nil {
+		bailOut(status.Error(codes.FailedPrecondition, err.Error()))
+		return
+	}
+	connectAddr = req.ConnectRequest.HostPort
+
+	if !admit() {
+		return
+	}
+	defer release()
+
+	destConn, nextHop, err := s.dialDestination(streamCtx, user, req.ConnectRequest.HostPort)
+	if err != nil {
+		sendConnectResponse(destinationHTTPError(err))
 		bailOut(err)
 		return
 	}
 	defer destConn.Close()
+	if s.cfg.EgressSource.HasSources(user) {
+		if addr, ok := destConn.LocalAddr().(*net.TCPAddr); ok {
+			egressAddr = addr.IP.String()
+		}
+	}
 
 	if err := sendConnectResponse(nil); err != nil {
 		bailOut(err)
@@ -124,9 +244,15 @@ func doRun(stream Stream, statusErr *error) {
 	}
 	logReq(codes.OK)
 
+	s.tunnel(stream, destConn, user, quota)
+}
+
+func (s *httpProxyServer) tunnel(stream Stream, conn net.Conn, user string, quota *quotaAccount) {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		handleBinaryTunneling(stream, destConn, cancel)
+		limits := s.cfg.RateLimits.serverTunnelLimits(user)
+		limits.Quota = quota
+		handleBinaryTunneling(stream, conn, cancel, limits)
 	}()
 
 	<-ctx.Done()
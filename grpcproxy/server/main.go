@@ -66,8 +66,17 @@ func Main() bool {
 		opts = append(opts, grpc.ChainUnaryInterceptor(ai.ProcessUnary), grpc.ChainStreamInterceptor(ai.ProcessStream))
 	}
 
+	proxyCfg, err := grpcproxy.MakeServerConfig(authLst)
+	if err != nil {
+		return false
+	}
+	// saves traffic usage
+	defer proxyCfg.Quotas.Close()
+	defer proxyCfg.NextHops.Close()
+	defer proxyCfg.Reverse.Close()
+
 	server := grpc.NewServer(opts...)
-	grpcproxy.RegisterProxySvc(server)
+	grpcproxy.RegisterProxySvc(server, proxyCfg)
 	healthcheck.RegisterHealthcheckSvc(server, "proxy-over-grpc server", startTimestamp, Version)
 	gstacks.RegisterGStacksSvc(server)
 
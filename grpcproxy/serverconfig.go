@@ -0,0 +1,145 @@
+package grpcproxy
+
+import (
+	"strings"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// ServerConfig is the pog server settings
+type ServerConfig struct {
+	UDPIdleTimeout time.Duration // UDP association is closed after no datagrams for that long [60s]
+
+	ACL ACLPolicy // destination ACLs per account, see MakeACLPolicy()
+
+	EgressGuard *EgressGuard // SSRF protection, nil if disabled
+
+	RateLimits *RateLimits // bandwidth limits per account and for the whole server
+
+	Quotas *Quotas // traffic quotas per account, see NewQuotas()
+
+	TunnelCaps *TunnelCaps // concurrent tunnels limits per account and per peer IP
+
+	Resolver *Resolver // DNS_UPSTREAMS resolver, nil for the system one
+
+	EgressSource *EgressSourcePolicy // local addresses to connect from, nil for the system' choice
+
+	Upstream *UpstreamRouter // UPSTREAM_PROXY to connect to destinations through, nil if none
+
+	NextHops *NextHopRouter // next pog servers (multi-hop), nil if none
+
+	Reverse *ReverseListeners // reverse tunnels, nil if disabled
+}
+
+func MakeServerConfig(authLst []AuthItem) (ServerConfig, error) {
+	cfg := ServerConfig{}
+
+	util.DurationEnv(&cfg.UDPIdleTimeout, "UDP_IDLE_TIMEOUT", 60*time.Second)
+
+	var aclFile string
+	util.StringEnv(&aclFile, "POG_ACL_FILE", "")
+
+	var err error
+	cfg.ACL, err = MakeACLPolicy(authLst, aclFile)
+	if err != nil {
+		return cfg, err
+	}
+
+	var globalRate int
+	util.IntEnv(&globalRate, "RATE_LIMIT", 0)
+	cfg.RateLimits = NewRateLimits(int64(globalRate), authLst)
+
+	var usageFile string
+	util.StringEnv(&usageFile, "QUOTA_USAGE_FILE", "")
+
+	var store UsageStore = NewMemoryUsageStore()
+	if usageFile != "" {
+		var flushInterval time.Duration
+		util.DurationEnv(&flushInterval, "QUOTA_FLUSH_INTERVAL", 10*time.Second)
+
+		store, err = NewFileUsageStore(usageFile, flushInterval)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	cfg.Quotas, err = NewQuotas(authLst, store)
+	if err != nil {
+		store.Close()
+		return cfg, err
+	}
+
+	var perUser, perIP int
+	util.IntEnv(&perUser, "MAX_TUNNELS_PER_USER", 0)
+	util.IntEnv(&perIP, "MAX_TUNNELS_PER_IP", 0)
+	cfg.TunnelCaps = NewTunnelCaps(perUser, perIP, authLst)
+
+	var dnsUpstreams string
+	util.StringEnv(&dnsUpstreams, "DNS_UPSTREAMS", "")
+	if dnsUpstreams != "" {
+		var prefer string
+		util.StringEnv(&prefer, "DNS_PREFER", "ipv4")
+
+		var timeout, negativeTTL time.Duration
+		util.DurationEnv(&timeout, "DNS_TIMEOUT", 5*time.Second)
+		util.DurationEnv(&negativeTTL, "DNS_NEGATIVE_TTL", 30*time.Second)
+
+		cfg.Resolver, err = NewResolver(strings.Split(dnsUpstreams, ","), prefer, timeout, negativeTTL)
+		if err != nil {
+			util.Error(err)
+			return cfg, err
+		}
+	}
+
+	var egressSource string
+	util.StringEnv(&egressSource, "EGRESS_SOURCE", "")
+	cfg.EgressSource, err = NewEgressSourcePolicy(strings.Split(egressSource, ","), authLst)
+	if err != nil {
+		return cfg, err
+	}
+
+	var upstreamProxy, upstreamRules string
+	util.StringEnv(&upstreamProxy, "UPSTREAM_PROXY", "")
+	util.StringEnv(&upstreamRules, "UPSTREAM_RULES", "")
+	cfg.Upstream, err = NewUpstreamRouter(upstreamProxy, strings.Split(upstreamRules, ","))
+	if err != nil {
+		return cfg, err
+	}
+
+	hops, err := ParseNextHops(NextHopEnvVarPrefix)
+	if err != nil {
+		return cfg, err
+	}
+	var nextHopRules string
+	util.StringEnv(&nextHopRules, "NEXT_HOP_RULES", "")
+	cfg.NextHops, err = NewNextHopRouter(hops, strings.Split(nextHopRules, ","), authLst)
+	if err != nil {
+		return cfg, err
+	}
+
+	var reverseAllow, reverseListen, reverseBindHost string
+	util.StringEnv(&reverseAllow, "REVERSE_ALLOW", "")
+	util.StringEnv(&reverseListen, "REVERSE_LISTEN", "")
+	util.StringEnv(&reverseBindHost, "REVERSE_BIND_HOST", "")
+	cfg.Reverse, err = NewReverseListeners(strings.Split(reverseAllow, ","), authLst, reverseListen, reverseBindHost)
+	if err != nil {
+		return cfg, err
+	}
+
+	var egressGuard bool
+	util.BoolEnv(&egressGuard, "EGRESS_GUARD", true)
+	if egressGuard {
+		var allowlist string
+		util.StringEnv(&allowlist, "EGRESS_ALLOW", "")
+
+		var selfPort int
+		util.IntEnv(&selfPort, "PORT", 8080)
+
+		cfg.EgressGuard, err = NewEgressGuard(allowlist, selfPort)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
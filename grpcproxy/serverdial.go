@@ -0,0 +1,234 @@
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const destDialTimeout = 10 * time.Second
+
+// destinationHTTPError makes ConnectResponse error out of dialDestination() error
+func destinationHTTPError(err error) *pb.HTTPError {
+	// the next hop' answer
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		return connectErr.HTTPError
+	}
+
+	code := http.StatusServiceUnavailable
+	msg := err.Error()
+	if st, ok := status.FromError(err); ok {
+		msg = st.Message()
+		switch st.Code() {
+		case codes.PermissionDenied:
+			code = http.StatusForbidden
+		case codes.ResourceExhausted:
+			code = http.StatusTooManyRequests
+		case codes.NotFound:
+			code = http.StatusNotFound
+		}
+	}
+
+	return &pb.HTTPError{
+		StatusCode: int32(code),
+		Error:      msg,
+	}
+}
+
+// checkDestination applies the egress guard and the account' ACL to host:port,
+// ips are to be resolved already, see needsIPs()
+func (s *httpProxyServer) checkDestination(user string, host string, ips []net.IP, port int) error {
+	if err := s.cfg.EgressGuard.Check(host, ips, port); err != nil {
+		return err
+	}
+
+	return s.checkACL(user, host, ips, port)
+}
+
+func (s *httpProxyServer) checkACL(user string, host string, ips []net.IP, port int) error {
+	acl := s.cfg.ACL.ForUser(user)
+	if rule, ok := acl.Check(host, ips, port); !ok {
+		hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+		util.Infof("acl: %s is denied to connect to %s by rule %q", user, hostPort, rule)
+		aclDeniedCnt(rule, 1)
+
+		return status.Errorf(codes.PermissionDenied, "connecting to %s is forbidden by rule %q", hostPort, rule)
+	}
+
+	return nil
+}
+
+// needsIPs tells if we resolve host names ourselves, not leaving it to net.Dial()
+func (s *httpProxyServer) needsIPs(user string) bool {
+	return s.cfg.Resolver != nil || s.cfg.EgressGuard != nil || s.cfg.ACL.ForUser(user).NeedsIPs() ||
+		s.cfg.EgressSource.HasSources(user) || s.cfg.Upstream.NeedsIPs()
+}
+
+func (s *httpProxyServer) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if s.cfg.Resolver != nil {
+		return s.cfg.Resolver.LookupIP(ctx, host)
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func splitHostPort(hostPort string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad port in %q", hostPort)
+	}
+
+	return host, port, nil
+}
+
+// dialDestination connects to hostPort on behalf of user with respect to the server policies,
+// nextHop is the name of the pog server the tunnel goes through, if any
+func (s *httpProxyServer) dialDestination(ctx context.Context, user string, hostPort string) (conn net.Conn, nextHop string, err error) {
+	host, port, err := splitHostPort(hostPort)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the next hop resolves and checks destinations against its own network,
+	// only the account' ACL is up to us
+	if hop := s.cfg.NextHops.Route(user, host, port); hop != nil {
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		}
+		if err := s.checkACL(user, host, ips, port); err != nil {
+			return nil, "", err
+		}
+
+		conn, err := hop.dial(ctx, hostPort)
+		return conn, hop.Name, err
+	}
+
+	conn, err = s.dialDirect(ctx, user, host, port)
+	return conn, "", err
+}
+
+func (s *httpProxyServer) dialDirect(ctx context.Context, user string, host string, port int) (net.Conn, error) {
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	}
+	resolve := func() (err error) {
+		if ips == nil {
+			ips, err = s.lookupIP(ctx, host)
+		}
+		return err
+	}
+
+	// the upstream resolves host names on its own (our network may lack
+	// external DNS) and gets them as they are; only CIDR rules of
+	// UPSTREAM_RULES make us resolve the destination to choose the route
+	if s.cfg.Upstream.NeedsIPs() {
+		if err := resolve(); err != nil {
+			return nil, err
+		}
+	}
+	if up := s.cfg.Upstream.Route(host, ips, port); up != nil {
+		if err := s.checkDestination(user, host, ips, port); err != nil {
+			return nil, err
+		}
+		return up.dial(ctx, hostPort)
+	}
+
+	if s.needsIPs(user) {
+		if err := resolve(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkDestination(user, host, ips, port); err != nil {
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		return net.DialTimeout("tcp", hostPort, destDialTimeout)
+	}
+
+	// we dial the very IPs we have checked
+	src := s.cfg.EgressSource.Pick(user, host, ips, port)
+	return dialIPs(ctx, ips, port, src)
+}
+
+// dialIPs connects to the first available IP, from src if it is not nil
+func dialIPs(ctx context.Context, ips []net.IP, port int, src *egressSource) (net.Conn, error) {
+	var err error
+	for _, ip := range ips {
+		dialer := net.Dialer{Timeout: destDialTimeout}
+		if src != nil {
+			var localIP net.IP
+			localIP, err = src.localIP(ip)
+			if err != nil {
+				continue
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: localIP}
+		}
+
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// resolveUDPDestination is dialDestination() for datagrams: the first allowed IP of hostPort
+func (s *httpProxyServer) resolveUDPDestination(ctx context.Context, user string, hostPort string, conns udpConns) (*net.UDPAddr, error) {
+	host, port, err := splitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	// datagrams are not relayed via next hops, and they are not to exit from
+	// here bypassing the one chosen
+	if hop := s.cfg.NextHops.Route(user, host, port); hop != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "%s goes via next hop %s, UDP is not relayed there", hostPort, hop.Name)
+	}
+
+	ips, err := s.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	// a datagram goes to a single address, of a family we have a socket for
+	var ip net.IP
+	for _, candidate := range ips {
+		if conns.forDst(candidate) != nil {
+			ip = candidate
+			break
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("no egress address to reach %s", host)
+	}
+	if err := s.checkDestination(user, host, []net.IP{ip}, port); err != nil {
+		return nil, err
+	}
+
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,301 @@
+package grpcproxy
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	hcpb "git.catbo.net/muravjov/go2023/healthcheck/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// ServerPool spreads tunnels over several pog servers (client side):
+//   - servers are checked with the healthcheck RPC every interval, the RPC time is
+//     the server' latency
+//   - policies order the servers for a tunnel: "priority" (as listed),
+//     "round-robin" or "least-latency"; unhealthy servers go last
+//   - a tunnel which fails before ConnectResponse because of the server (gRPC
+//     failure) is retried on the next server; ConnectError is the destination' answer
+//     and is not retried
+type ServerPool struct {
+	servers []*poolServer
+	policy  string
+
+	next atomic.Uint32 // for round-robin
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+const (
+	PoolPolicyPriority     = "priority"
+	PoolPolicyRoundRobin   = "round-robin"
+	PoolPolicyLeastLatency = "least-latency"
+)
+
+type poolServer struct {
+	addr string
+
+	conn   ClientConn
+	client pb.HTTPProxyClient
+	hc     hcpb.HealthcheckClient
+	mux    *muxClient
+
+	mu      sync.Mutex
+	healthy bool
+	latency time.Duration
+}
+
+var (
+	poolServerHealthy = util.NewGaugeVecMetric(
+		"pool_server_healthy",
+		"Is pog server healthy (1) or not (0), by address",
+		[]string{"name"},
+	)
+
+	poolServerLatency = util.NewGaugeVecMetric(
+		"pool_server_latency_seconds",
+		"Healthcheck RPC time of pog server, by address",
+		[]string{"name"},
+	)
+
+	poolServerRetries = util.MakeCounterVecFunc(
+		"pool_server_retries_total",
+		"Number of tunnels retried on another pog server, by the failed server address",
+	)
+)
+
+// ResolveServerAddrs expands "srv:_pog._tcp.example.com" items into the SRV
+// targets (by priority, then by weight), other items are host:port as is
+func ResolveServerAddrs(lst []string) ([]string, error) {
+	var addrs []string
+	for _, item := range lst {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, isSRV := strings.CutPrefix(item, "srv:")
+		if !isSRV {
+			addrs = append(addrs, item)
+			continue
+		}
+
+		_, srvs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve SRV %s: %v", name, err)
+		}
+		// LookupSRV() sorts by priority and randomizes by weight
+		for _, srv := range srvs {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no pog servers")
+	}
+	return addrs, nil
+}
+
+// NewServerPool dials addrs with dial and starts health checks
+func NewServerPool(addrs []string, policy string, interval time.Duration, dial func(addr string) (ClientConn, error)) (*ServerPool, error) {
+	switch policy {
+	case PoolPolicyPriority, PoolPolicyRoundRobin, PoolPolicyLeastLatency:
+	default:
+		return nil, fmt.Errorf("unknown server pool policy %q", policy)
+	}
+
+	pool := &ServerPool{
+		policy: policy,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for _, addr := range addrs {
+		conn, err := dial(addr)
+		if err != nil {
+			pool.closeConns()
+			return nil, fmt.Errorf("failed to dial server %s: %v", addr, err)
+		}
+
+		pool.servers = append(pool.servers, &poolServer{
+			addr:   addr,
+			conn:   conn,
+			client: pb.NewHTTPProxyClient(conn),
+			hc:     hcpb.NewHealthcheckClient(conn),
+			// optimistic till the first check
+			healthy: true,
+		})
+	}
+
+	pool.checkAll(interval)
+	go func() {
+		defer close(pool.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pool.checkAll(interval)
+			case <-pool.stop:
+				return
+			}
+		}
+	}()
+
+	return pool, nil
+}
+
+func (pool *ServerPool) closeConns() {
+	for _, ps := range pool.servers {
+		ps.conn.Close()
+	}
+}
+
+func (pool *ServerPool) Close() {
+	close(pool.stop)
+	<-pool.done
+
+	pool.closeConns()
+}
+
+func (pool *ServerPool) enableMux() {
+	for _, ps := range pool.servers {
+		ps.mux = &muxClient{client: ps.client}
+	}
+}
+
+func (pool *ServerPool) checkAll(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, ps := range pool.servers {
+		wg.Add(1)
+		go func(ps *poolServer) {
+			defer wg.Done()
+			ps.check(timeout)
+		}(ps)
+	}
+	wg.Wait()
+}
+
+func (ps *poolServer) check(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ps.hc.Invoke(ctx, &hcpb.Request{})
+	latency := time.Since(start)
+
+	if err != nil {
+		util.Debugf("pog server %s healthcheck failed: %v", ps.addr, err)
+		ps.setHealthy(false)
+		return
+	}
+
+	ps.mu.Lock()
+	// smoothed, a single slow check should not reorder servers
+	if ps.latency == 0 {
+		ps.latency = latency
+	} else {
+		ps.latency = (3*ps.latency + latency) / 4
+	}
+	poolServerLatency.WithLabelValues(ps.addr).Set(ps.latency.Seconds())
+	ps.mu.Unlock()
+
+	ps.setHealthy(true)
+}
+
+func (ps *poolServer) setHealthy(healthy bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.healthy != healthy {
+		util.Infof("pog server %s is healthy: %v", ps.addr, healthy)
+	}
+	ps.healthy = healthy
+
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	poolServerHealthy.WithLabelValues(ps.addr).Set(v)
+}
+
+func (ps *poolServer) state() (bool, time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.healthy, ps.latency
+}
+
+func (ps *poolServer) newStream(ctx context.Context) (ClientStream, error) {
+	return newStreamVia(ctx, ps.client, ps.mux)
+}
+
+// order lists servers to try for a tunnel
+func (pool *ServerPool) order() []*poolServer {
+	lst := slices.Clone(pool.servers)
+
+	switch pool.policy {
+	case PoolPolicyRoundRobin:
+		n := int(pool.next.Add(1)-1) % len(lst)
+		lst = append(lst[n:], lst[:n]...)
+	case PoolPolicyLeastLatency:
+		slices.SortStableFunc(lst, func(a, b *poolServer) int {
+			_, la := a.state()
+			_, lb := b.state()
+			// never checked servers go after measured ones
+			if (la == 0) != (lb == 0) {
+				return cmp.Compare(lb, la)
+			}
+			return cmp.Compare(la, lb)
+		})
+	}
+
+	// healthy ones first, keeping the order
+	slices.SortStableFunc(lst, func(a, b *poolServer) int {
+		ha, _ := a.state()
+		hb, _ := b.state()
+		switch {
+		case ha == hb:
+			return 0
+		case ha:
+			return -1
+		}
+		return 1
+	})
+
+	return lst
+}
+
+// openStream is openStream() with retries on the next servers
+func (pool *ServerPool) openStream(ctx context.Context, packet *pb.Packet) (ClientStream, error) {
+	var err error
+	for _, ps := range pool.order() {
+		var stream ClientStream
+		stream, err = openStreamVia(ctx, ps, packet)
+		if err == nil {
+			return stream, nil
+		}
+
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		util.Infof("tunnel via pog server %s failed: %v", ps.addr, err)
+		ps.setHealthy(false)
+		poolServerRetries(ps.addr, 1)
+	}
+
+	return nil, err
+}
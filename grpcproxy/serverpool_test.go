@@ -0,0 +1,93 @@
+package grpcproxy
+
+import (
+	"testing"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"git.catbo.net/muravjov/go2023/healthcheck"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// startPoolServer runs a pog server with the healthcheck which connects from egressIP
+func startPoolServer(t *testing.T, egressIP string) string {
+	var err error
+	cfg := makeTestServerConfig(t)
+	cfg.EgressSource, err = NewEgressSourcePolicy([]string{egressIP}, nil)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	RegisterProxySvc(server, cfg)
+	healthcheck.RegisterHealthcheckSvc(server, "pog", time.Now(), "test")
+
+	sc, err := grpctest.StartServerClient(server)
+	require.NoError(t, err)
+	t.Cleanup(sc.Close)
+
+	return sc.Addr.String()
+}
+
+func dialInsecure(addr string) (ClientConn, error) {
+	return grpctest.DialInsecure(addr)
+}
+
+func startPoolClient(t *testing.T, addrs []string, policy string) (*ServerPool, *ProxyClientContext) {
+	pool, err := NewServerPool(addrs, policy, time.Hour, dialInsecure)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	pcc, err := NewProxyClientContext(nil)
+	require.NoError(t, err)
+	pcc.Pool = pool
+
+	return pool, pcc
+}
+
+func TestServerPoolFailover(t *testing.T) {
+	addr := startWhoAmIServer(t)
+
+	// nobody listens there
+	l := grpctest.NewLocalListener()
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	pool, pcc := startPoolClient(t, []string{deadAddr, startPoolServer(t, "127.0.0.2")}, PoolPolicyPriority)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	// the dead server has failed the first healthcheck
+	require.Equal(t, "127.0.0.2", whoAmI(t, proxyURL, addr))
+	healthy, _ := pool.servers[0].state()
+	require.False(t, healthy)
+
+	// a failure before the check is retried on the next server
+	pool.servers[0].setHealthy(true)
+	require.Equal(t, "127.0.0.2", whoAmI(t, proxyURL, addr))
+	healthy, _ = pool.servers[0].state()
+	require.False(t, healthy)
+}
+
+func TestServerPoolPolicies(t *testing.T) {
+	addr := startWhoAmIServer(t)
+	addrs := []string{startPoolServer(t, "127.0.0.2"), startPoolServer(t, "127.0.0.3")}
+
+	_, pcc := startPoolClient(t, addrs, PoolPolicyRoundRobin)
+	proxyURL := startLocalPOGClient(t, pcc)
+	pcc.EnableMux()
+
+	require.Equal(t, "127.0.0.2", whoAmI(t, proxyURL, addr))
+	require.Equal(t, "127.0.0.3", whoAmI(t, proxyURL, addr))
+	require.Equal(t, "127.0.0.2", whoAmI(t, proxyURL, addr))
+
+	pool, _ := startPoolClient(t, addrs, PoolPolicyLeastLatency)
+	pool.servers[0].latency = 2 * time.Millisecond
+	pool.servers[1].latency = time.Millisecond
+	require.Equal(t, addrs[1], pool.order()[0].addr)
+
+	// latency of a server which has not been checked is unknown rather than zero
+	pool.servers[1].latency = 0
+	require.Equal(t, addrs[0], pool.order()[0].addr)
+
+	_, err := NewServerPool(addrs, "random", time.Hour, dialInsecure)
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// ServerRouter sends tunnels to named pog servers by destination (client side):
+// the servers are set with CLIENT_POG_SERVER_* env variables, the same JSON as
+// POG_NEXT_HOP_* ones; SERVER_RULES "<server name> <ACL rule>" or
+// "default <ACL rule>" are checked, the first matching rule wins; the rest go
+// to the default server (SERVER_ADDR).
+// UDP associations and reverse tunnels always go via the default server
+type ServerRouter struct {
+	servers  map[string]*NextHop
+	rules    []serverRule
+	needsIPs bool
+}
+
+const ClientServerEnvVarPrefix = "CLIENT_POG_SERVER_"
+
+// DefaultServerName is the name of SERVER_ADDR server in SERVER_RULES, logs and metrics
+const DefaultServerName = "default"
+
+type serverRule struct {
+	rule   ACLRule
+	server *NextHop // nil for the default server
+}
+
+var serverTunnels = util.NewCounterVecMetric(
+	"server_tunnels_total",
+	"Number of tunnels via named pog servers, by server name and HTTP-like status code",
+	[]string{"server", "code"},
+)
+
+func countServerTunnel(server string, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = tunnelErrorCode(err)
+	}
+	serverTunnels.WithLabelValues(server, strconv.Itoa(code)).Inc()
+}
+
+func ParseClientServers(envVarPrefix string) ([]*NextHop, error) {
+	return parseNamedServers(envVarPrefix, "pog server")
+}
+
+// NewServerRouter connects to servers, it returns nil if there are no servers;
+// rules are checked anyway, so a rule of a missing server is an error
+func NewServerRouter(servers []*NextHop, rules []string) (*ServerRouter, error) {
+	sr := &ServerRouter{
+		servers: map[string]*NextHop{},
+	}
+
+	err := sr.init(servers, rules)
+	if err != nil {
+		util.Error(err)
+		sr.Close()
+		return nil, err
+	}
+
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	return sr, nil
+}
+
+func (sr *ServerRouter) init(servers []*NextHop, rules []string) error {
+	for _, server := range servers {
+		if _, ok := sr.servers[server.Name]; ok || server.Name == DefaultServerName {
+			return fmt.Errorf("pog server name %q is duplicated or reserved", server.Name)
+		}
+		sr.servers[server.Name] = server
+	}
+
+	for _, s := range rules {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		name, ruleText, _ := strings.Cut(s, " ")
+		var r serverRule
+		if name != DefaultServerName {
+			r.server = sr.servers[name]
+			if r.server == nil {
+				return fmt.Errorf("server rule %q: unknown pog server %q", s, name)
+			}
+		}
+
+		var err error
+		r.rule, err = ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			return err
+		}
+		sr.rules = append(sr.rules, r)
+		if r.rule.cidr != nil {
+			sr.needsIPs = true
+		}
+	}
+
+	for _, server := range servers {
+		if err := server.connect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sr *ServerRouter) Close() {
+	if sr == nil {
+		return
+	}
+
+	for _, server := range sr.servers {
+		if server.conn != nil {
+			server.conn.Close()
+		}
+	}
+}
+
+// Route returns the pog server for hostPort, nil for the default one; ips are
+// the destination' addresses if resolved already
+func (sr *ServerRouter) Route(ctx context.Context, hostPort string, ips []net.IP) *NextHop {
+	if sr == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	ips = ruleIPs(ctx, host, ips, sr.needsIPs)
+	for _, r := range sr.rules {
+		if r.rule.Match(host, ips, port) {
+			return r.server
+		}
+	}
+	return nil
+}
+
+func serverName(server *NextHop) string {
+	if server == nil {
+		return DefaultServerName
+	}
+	return server.Name
+}
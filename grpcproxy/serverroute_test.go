@@ -0,0 +1,48 @@
+package grpcproxy
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerRouter(t *testing.T) {
+	addr := startWhoAmIServer(t)
+	exitAddr := startExitPOG(t, nil)
+
+	serverTunnelCount := func(server string) float64 {
+		metric := dto.Metric{}
+		serverTunnels.WithLabelValues(server, "200").Write(&metric)
+		return metric.GetCounter().GetValue()
+	}
+
+	proxyURL, pcc := startLocalPOG(t)
+	check := func(expectedIP, expectedServer string, rules ...string) {
+		eu := &NextHop{Name: "eu", Addr: exitAddr, Auth: "edge:secret", Insecure: true}
+		var err error
+		pcc.Servers, err = NewServerRouter([]*NextHop{eu}, rules)
+		require.NoError(t, err)
+		defer pcc.Servers.Close()
+
+		before := serverTunnelCount(expectedServer)
+		require.Equal(t, expectedIP, whoAmI(t, proxyURL, addr))
+		require.Equal(t, before+1, serverTunnelCount(expectedServer))
+	}
+
+	check("127.0.0.2", "eu", "eu *")
+	check("127.0.0.1", DefaultServerName, "default 127.0.0.0/8", "eu *")
+	check("127.0.0.1", DefaultServerName, "eu *.example.com")
+
+	_, err := NewServerRouter([]*NextHop{{Name: "eu", Addr: exitAddr}}, []string{"us *"})
+	require.Error(t, err)
+	_, err = NewServerRouter([]*NextHop{{Name: DefaultServerName, Addr: exitAddr}}, nil)
+	require.Error(t, err)
+
+	// rules are checked without servers too
+	_, err = NewServerRouter(nil, []string{"eu *"})
+	require.Error(t, err)
+	sr, err := NewServerRouter(nil, []string{"default *"})
+	require.NoError(t, err)
+	require.Nil(t, sr)
+}
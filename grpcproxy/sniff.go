@@ -0,0 +1,90 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const sniffTimeout = 10 * time.Second
+
+var errSniffed = errors.New("sniffed")
+
+// sniffServerName reads the beginning of conn to find the host name the peer
+// wants: TLS SNI or HTTP Host; the returned conn replays the bytes read
+func sniffServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(conn, &buf))
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	name, err := readServerName(br)
+	conn.SetReadDeadline(time.Time{})
+
+	replay := &bufferedConn{conn, bufio.NewReader(io.MultiReader(&buf, conn))}
+	if err != nil {
+		return "", replay, err
+	}
+	return strings.ToLower(strings.TrimSuffix(name, ".")), replay, nil
+}
+
+func readServerName(br *bufio.Reader) (string, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	// TLS handshake record
+	if first[0] == 0x16 {
+		var hello *tls.ClientHelloInfo
+		err := tls.Server(&readOnlyConn{r: br}, &tls.Config{
+			GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello = h
+				return nil, errSniffed
+			},
+		}).Handshake()
+		if hello == nil {
+			return "", err
+		}
+		if hello.ServerName == "" {
+			return "", errors.New("no SNI in TLS ClientHello")
+		}
+		return hello.ServerName, nil
+	}
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	}
+	if req.Method == http.MethodConnect {
+		return "", errors.New("CONNECT requests are not routed")
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return "", errors.New("no Host in HTTP request")
+	}
+	return host, nil
+}
+
+// readOnlyConn lets crypto/tls parse ClientHello without answering it
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
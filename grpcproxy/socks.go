@@ -0,0 +1,557 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// SOCKS5 is RFC 1928 (+ RFC 1929 for username/password auth),
+// SOCKS4a is https://www.openssh.com/txt/socks4a.protocol
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+
+	socksCmdConnect       = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded          = 0x00
+	socks5RepGeneralFailure     = 0x01
+	socks5RepNotAllowed         = 0x02
+	socks5RepNetworkUnreachable = 0x03
+	socks5RepHostUnreachable    = 0x04
+	socks5RepConnectionRefused  = 0x05
+	socks5RepTTLExpired         = 0x06
+	socks5RepCmdNotSupported    = 0x07
+	socks5RepAtypNotSupported   = 0x08
+
+	socks4RepGranted  = 90
+	socks4RepRejected = 91
+)
+
+var errSOCKSAtypNotSupported = errors.New("address type not supported")
+
+// defaultSOCKSHandshakeTimeout is ProxyClientContext.SOCKSHandshakeTimeout
+// set by NewProxyClientContext()
+const defaultSOCKSHandshakeTimeout = 10 * time.Second
+
+// socks5ReplyCode maps an openTunnel() error to SOCKS5 reply code
+func socks5ReplyCode(err error) byte {
+	// the client dialed directly
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5RepHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RepTTLExpired
+	}
+
+	// pog server has only the status code for us
+	var connectErr *ConnectError
+	if !errors.As(err, &connectErr) {
+		return socks5RepGeneralFailure
+	}
+
+	switch connectErr.HTTPError.StatusCode {
+	case http.StatusForbidden:
+		return socks5RepNotAllowed
+	case http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return socks5RepHostUnreachable
+	case http.StatusGatewayTimeout:
+		return socks5RepTTLExpired
+	}
+
+	return socks5RepGeneralFailure
+}
+
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		l := net.IPv4len
+		if atyp[0] == socks5AtypIPv6 {
+			l = net.IPv6len
+		}
+
+		ip := make(net.IP, l)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errSOCKSAtypNotSupported
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKS5Addr is the reverse of readSOCKS5Addr()
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	ip := net.IPv4zero
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+func readNullTerminated(br *bufio.Reader) (string, error) {
+	s, err := br.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(s, "\x00"), nil
+}
+
+// ServeSOCKS handles a SOCKS5 or SOCKS4(a) connection: CONNECT and,
+// for SOCKS5, UDP ASSOCIATE commands are supported
+func ServeSOCKS(conn net.Conn, pcc *ProxyClientContext) {
+	defer conn.Close()
+
+	// cleared once the request is read
+	pcc.setHandshakeDeadline(conn)
+
+	br := bufio.NewReader(conn)
+	version, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+
+	switch version[0] {
+	case socks5Version:
+		serveSOCKS5(conn, br, pcc)
+	case socks4Version:
+		serveSOCKS4(conn, br, pcc)
+	default:
+		util.Errorf("unknown SOCKS version %d from %v", version[0], conn.RemoteAddr())
+	}
+}
+
+func serveSOCKS5(conn net.Conn, br *bufio.Reader, pcc *ProxyClientContext) {
+	connectAddr := "-"
+	user := "-"
+	userPass := ""
+	var route tunnelRoute
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: connectAddr,
+			User:        user,
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Code:        strconv.Itoa(code),
+			Proto:       "SOCKS5",
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
+		})
+	}
+
+	reply := func(rep byte, bindAddr net.Addr) error {
+		_, err := conn.Write(appendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, bindAddr))
+		return err
+	}
+
+	// greeting: VER NMETHODS METHODS
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+
+	method := byte(socks5AuthNone)
+	if len(pcc.AuthLst) > 0 {
+		method = socks5AuthPassword
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		logReq(http.StatusProxyAuthRequired)
+		return
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+
+	if method == socks5AuthPassword {
+		// VER ULEN UNAME PLEN PASSWD
+		readField := func() (string, error) {
+			var l [1]byte
+			if _, err := io.ReadFull(br, l[:]); err != nil {
+				return "", err
+			}
+			b := make([]byte, l[0])
+			_, err := io.ReadFull(br, b)
+			return string(b), err
+		}
+
+		var ver [1]byte
+		if _, err := io.ReadFull(br, ver[:]); err != nil {
+			return
+		}
+		if ver[0] != socks5PasswordVersion {
+			conn.Write([]byte{socks5PasswordVersion, 0x01})
+			logReq(http.StatusBadRequest)
+			return
+		}
+		name, err := readField()
+		if err != nil {
+			return
+		}
+		pass, err := readField()
+		if err != nil {
+			return
+		}
+
+		user, err = checkUserPassword(name, pass, pcc.AuthLst)
+		if err != nil {
+			user = "-"
+			conn.Write([]byte{socks5PasswordVersion, 0x01})
+			logReq(http.StatusProxyAuthRequired)
+			return
+		}
+		if _, err := conn.Write([]byte{socks5PasswordVersion, 0x00}); err != nil {
+			return
+		}
+		userPass = name + ":" + pass
+	} else {
+		user = "anonymous"
+	}
+
+	// request: VER CMD RSV DST.ADDR DST.PORT
+	var req [3]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return
+	}
+	if req[0] != socks5Version || req[2] != 0x00 {
+		reply(socks5RepGeneralFailure, nil)
+		logReq(http.StatusBadRequest)
+		return
+	}
+	addr, err := readSOCKS5Addr(br)
+	if err != nil {
+		if err == errSOCKSAtypNotSupported {
+			reply(socks5RepAtypNotSupported, nil)
+			logReq(http.StatusBadRequest)
+		}
+		return
+	}
+	connectAddr = addr
+	conn.SetReadDeadline(time.Time{})
+
+	release, err := pcc.TunnelCaps.Acquire(user, "")
+	if err != nil {
+		reply(socks5RepGeneralFailure, nil)
+		logReq(http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = pcc.POGAuth.withUser(ctx, user, userPass)
+
+	switch req[1] {
+	case socksCmdConnect:
+	case socks5CmdUDPAssociate:
+		serveSOCKS5UDP(ctx, conn, br, pcc, reply, logReq)
+		return
+	default:
+		reply(socks5RepCmdNotSupported, nil)
+		logReq(http.StatusNotImplemented)
+		return
+	}
+
+	stream, route, err := openRoutedTunnel(ctx, pcc, connectAddr)
+	if err != nil {
+		reply(socks5ReplyCode(err), nil)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+
+	if err := reply(socks5RepSucceeded, nil); err != nil {
+		return
+	}
+	logReq(http.StatusOK)
+
+	handleBinaryTunneling(stream, &bufferedConn{conn, br}, cancel, pcc.RateLimits.clientTunnelLimits(user))
+}
+
+func serveSOCKS4(conn net.Conn, br *bufio.Reader, pcc *ProxyClientContext) {
+	connectAddr := "-"
+	user := "-"
+	var route tunnelRoute
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: connectAddr,
+			User:        user,
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Code:        strconv.Itoa(code),
+			Proto:       "SOCKS4",
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
+		})
+	}
+
+	reply := func(rep byte) error {
+		_, err := conn.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+
+	// VN CD DSTPORT DSTIP USERID NULL [HOST NULL]
+	var req [8]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(req[2:4])
+	ip := net.IP(req[4:8])
+
+	userID, err := readNullTerminated(br)
+	if err != nil {
+		return
+	}
+
+	host := ip.String()
+	// SOCKS4a: 0.0.0.x, x != 0 means a host name follows
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readNullTerminated(br)
+		if err != nil {
+			return
+		}
+	}
+	connectAddr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	conn.SetReadDeadline(time.Time{})
+
+	// SOCKS4 has no passwords
+	if len(pcc.AuthLst) > 0 {
+		user = userID
+		reply(socks4RepRejected)
+		logReq(http.StatusProxyAuthRequired)
+		return
+	}
+	user = "anonymous"
+
+	if req[1] != socksCmdConnect {
+		reply(socks4RepRejected)
+		logReq(http.StatusNotImplemented)
+		return
+	}
+
+	release, err := pcc.TunnelCaps.Acquire(user, "")
+	if err != nil {
+		reply(socks4RepRejected)
+		logReq(http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, route, err := openRoutedTunnel(ctx, pcc, connectAddr)
+	if err != nil {
+		reply(socks4RepRejected)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+
+	if err := reply(socks4RepGranted); err != nil {
+		return
+	}
+	logReq(http.StatusOK)
+
+	handleBinaryTunneling(stream, &bufferedConn{conn, br}, cancel, pcc.RateLimits.clientTunnelLimits(user))
+}
+
+// bufferedConn is a net.Conn which reads via a bufio.Reader,
+// so no peeked/buffered bytes are lost
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// setHandshakeDeadline limits protocol detection and SOCKS handshake
+// till the request is read
+func (pcc *ProxyClientContext) setHandshakeDeadline(conn net.Conn) {
+	if pcc.SOCKSHandshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(pcc.SOCKSHandshakeTimeout))
+	}
+}
+
+// ServeSOCKSListener serves SOCKS connections until the listener is closed
+func ServeSOCKSListener(l net.Listener, pcc *ProxyClientContext) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			util.Errorf("SOCKS listener: %v", err)
+			return err
+		}
+
+		go ServeSOCKS(conn, pcc)
+	}
+}
+
+// NewSOCKSDetectListener returns a listener for HTTP server that serves
+// SOCKS connections on its own, so both protocols share the same port:
+// SOCKS starts with the version byte 4 or 5, and HTTP never does
+func NewSOCKSDetectListener(l net.Listener, pcc *ProxyClientContext) net.Listener {
+	sl := &socksDetectListener{
+		Listener: l,
+		pcc:      pcc,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go sl.acceptLoop()
+
+	return sl
+}
+
+type socksDetectListener struct {
+	net.Listener
+	pcc *ProxyClientContext
+
+	conns chan net.Conn
+	errs  chan error
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (sl *socksDetectListener) acceptLoop() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if err != nil {
+			select {
+			case sl.errs <- err:
+			case <-sl.done:
+				return
+			}
+
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go sl.detect(conn)
+	}
+}
+
+func (sl *socksDetectListener) detect(conn net.Conn) {
+	// a client which sends nothing is not to pin the goroutine
+	sl.pcc.setHandshakeDeadline(conn)
+
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	bc := &bufferedConn{conn, br}
+	if b[0] == socks4Version || b[0] == socks5Version {
+		ServeSOCKS(bc, sl.pcc)
+		return
+	}
+	// http.Server sets own timeouts, if any
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case sl.conns <- bc:
+	case <-sl.done:
+		conn.Close()
+	}
+}
+
+func (sl *socksDetectListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sl.conns:
+		return conn, nil
+	case err := <-sl.errs:
+		return nil, err
+	case <-sl.done:
+		return nil, fmt.Errorf("SOCKS detect listener: %w", net.ErrClosed)
+	}
+}
+
+func (sl *socksDetectListener) Close() error {
+	sl.closeOnce.Do(func() {
+		close(sl.done)
+	})
+	return sl.Listener.Close()
+}
@@ -0,0 +1,273 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+)
+
+// startEchoServer returns address of a TCP server which echoes lines back
+func startEchoServer(t *testing.T) string {
+	l := grpctest.NewLocalListener()
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func requireEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ping\n", line)
+}
+
+func TestSOCKS5(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	proxyURL, pcc := startLocalPOG(t)
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, nil, proxy.Direct)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	requireEcho(t, conn)
+
+	// dial errors are mapped to the proper reply code: pog server tells only
+	// the destination is unavailable, while direct dials have the errno
+	l := grpctest.NewLocalListener()
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	_, err = dialer.Dial("tcp", closedAddr)
+	require.ErrorContains(t, err, "host unreachable")
+
+	pcc.Router, err = NewClientRouter(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", closedAddr)
+	require.ErrorContains(t, err, "connection refused")
+	pcc.Router = nil
+
+	// username/password auth
+	hash, err := hashPassword("password")
+	require.NoError(t, err)
+	pcc.AuthLst = []AuthItem{{Name: "user", Hash: hash, ExpDate: time.Now().Add(time.Hour)}}
+
+	dialer, err = proxy.SOCKS5("tcp", proxyURL.Host, &proxy.Auth{User: "user", Password: "wrong"}, proxy.Direct)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", echoAddr)
+	require.Error(t, err)
+
+	dialer, err = proxy.SOCKS5("tcp", proxyURL.Host, &proxy.Auth{User: "user", Password: "password"}, proxy.Direct)
+	require.NoError(t, err)
+	conn2, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn2.Close()
+	requireEcho(t, conn2)
+
+	// username/password auth of a wrong version
+	raw, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.Write([]byte{socks5Version, 1, socks5AuthPassword, 0x02, 4, 'u', 's', 'e', 'r', 8, 'p', 'a', 's', 's', 'w', 'o', 'r', 'd'})
+	require.NoError(t, err)
+	resp, err := io.ReadAll(raw)
+	require.NoError(t, err)
+	require.Equal(t, []byte{socks5Version, socks5AuthPassword, socks5PasswordVersion, 0x01}, resp)
+
+	// a request of a wrong version or with RSV set
+	for _, req := range [][]byte{
+		{socks4Version, socksCmdConnect, 0x00},
+		{socks5Version, socksCmdConnect, 0x01},
+	} {
+		raw, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer raw.Close()
+
+		greeting := []byte{socks5Version, 1, socks5AuthPassword, socks5PasswordVersion, 4, 'u', 's', 'e', 'r', 8, 'p', 'a', 's', 's', 'w', 'o', 'r', 'd'}
+		_, err = raw.Write(append(greeting, req...))
+		require.NoError(t, err)
+		resp, err := io.ReadAll(raw)
+		require.NoError(t, err)
+		require.EqualValues(t, socks5RepGeneralFailure, resp[5], req)
+	}
+}
+
+func TestSOCKSHandshakeTimeout(t *testing.T) {
+	_, pcc := startLocalPOG(t)
+	pcc.SOCKSHandshakeTimeout = 100 * time.Millisecond
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	// silent clients are disconnected, both before detection and in the middle of SOCKS handshake
+	for _, greeting := range []string{"", "\x05\x01"} {
+		conn, err := net.Dial("tcp", proxyURL.Host)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte(greeting))
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadAll(conn)
+		require.NoError(t, err)
+	}
+}
+
+func TestSOCKS4a(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, port, err := net.SplitHostPort(echoAddr)
+	require.NoError(t, err)
+
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+
+	_, pcc := startLocalPOG(t)
+	go ServeSOCKSListener(l, pcc)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	p, err := net.LookupPort("tcp", port)
+	require.NoError(t, err)
+
+	// VN CD DSTPORT DSTIP(0.0.0.1) USERID NULL HOST NULL
+	req := []byte{socks4Version, socksCmdConnect, byte(p >> 8), byte(p), 0, 0, 0, 1}
+	req = append(req, "user\x00localhost\x00"...)
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+
+	var resp [8]byte
+	_, err = io.ReadFull(conn, resp[:])
+	require.NoError(t, err)
+	require.EqualValues(t, socks4RepGranted, resp[1])
+
+	requireEcho(t, conn)
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echoConn.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echoConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	// datagrams to rejected destinations are not relayed
+	rejectedConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer rejectedConn.Close()
+
+	_, pcc := startLocalPOG(t)
+	pcc.Router, err = NewClientRouter([]string{"reject " + rejectedConn.LocalAddr().String()}, nil)
+	require.NoError(t, err)
+	proxyURL := startLocalPOGClient(t, pcc)
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// greeting, no auth
+	_, err = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	require.NoError(t, err)
+	var method [2]byte
+	_, err = io.ReadFull(conn, method[:])
+	require.NoError(t, err)
+	require.EqualValues(t, socks5AuthNone, method[1])
+
+	// UDP ASSOCIATE 0.0.0.0:0
+	_, err = conn.Write(appendSOCKS5Addr([]byte{socks5Version, socks5CmdUDPAssociate, 0x00}, nil))
+	require.NoError(t, err)
+
+	var resp [3]byte
+	_, err = io.ReadFull(conn, resp[:])
+	require.NoError(t, err)
+	require.EqualValues(t, socks5RepSucceeded, resp[1])
+	relayAddr, err := readSOCKS5Addr(conn)
+	require.NoError(t, err)
+
+	udpConn, err := net.Dial("udp", relayAddr)
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	for _, msg := range []string{"ping", "pong"} {
+		req := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, echoConn.LocalAddr())
+		_, err = udpConn.Write(append(req, msg...))
+		require.NoError(t, err)
+
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, maxDatagramSize)
+		n, err := udpConn.Read(buf)
+		require.NoError(t, err)
+
+		r := bytes.NewReader(buf[3:n])
+		srcAddr, err := readSOCKS5Addr(r)
+		require.NoError(t, err)
+		require.Equal(t, echoConn.LocalAddr().String(), srcAddr)
+
+		payload, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, msg, string(payload))
+	}
+
+	req := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, rejectedConn.LocalAddr())
+	_, err = udpConn.Write(append(req, "ping"...))
+	require.NoError(t, err)
+	rejectedConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, _, err = rejectedConn.ReadFromUDP(make([]byte, maxDatagramSize))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestUDPDestinations(t *testing.T) {
+	ud := newUDPDestinations(2)
+	addr := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	now := time.Now()
+
+	ud.put("a:53", addr, now)
+	ud.put("b:53", nil, now.Add(time.Second))
+	got, ok := ud.get("a:53", now.Add(2*time.Second))
+	require.True(t, ok)
+	require.Equal(t, addr, got)
+
+	// the least recently used one goes
+	ud.put("c:53", addr, now.Add(3*time.Second))
+	require.Len(t, ud.items, 2)
+	_, ok = ud.get("b:53", now.Add(3*time.Second))
+	require.False(t, ok)
+
+	// idle ones go all at once
+	ud.put("d:53", addr, now.Add(time.Hour))
+	require.Len(t, ud.items, 1)
+}
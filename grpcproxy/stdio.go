@@ -0,0 +1,65 @@
+package grpcproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnectStdio opens a tunnel to hostPort and pipes in and out through it, like
+// netcat does (e.g. for ssh ProxyCommand); connect errors come with the status
+// code the pog server answered
+func ConnectStdio(pcc *ProxyClientContext, hostPort string, in io.Reader, out io.Writer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := openTunnel(ctx, pcc, hostPort)
+	if err != nil {
+		return fmt.Errorf("%v (%d)", err, tunnelErrorCode(err))
+	}
+	defer closeSend(stream)
+
+	handleBinaryTunneling(stream, &stdioConn{in: in, out: out}, cancel, pcc.RateLimits.clientTunnelLimits(""))
+	return nil
+}
+
+// stdioConn is a net.Conn of a reader and a writer; end of out is CloseWrite()
+type stdioConn struct {
+	in  io.Reader
+	out io.Writer
+}
+
+func (c *stdioConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *stdioConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func (c *stdioConn) CloseWrite() error {
+	if closer, ok := c.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *stdioConn) Close() error {
+	if closer, ok := c.in.(io.Closer); ok {
+		closer.Close()
+	}
+	return c.CloseWrite()
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (c *stdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *stdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return nil }
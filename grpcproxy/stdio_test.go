@@ -0,0 +1,26 @@
+package grpcproxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectStdio(t *testing.T) {
+	addr := startWhoAmIServer(t)
+	_, pcc := startLocalPOG(t)
+
+	var out bytes.Buffer
+	err := ConnectStdio(pcc, addr, strings.NewReader("?"), &out)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", out.String())
+
+	// nothing listens there
+	l := grpctest.NewLocalListener()
+	l.Close()
+	err = ConnectStdio(pcc, l.Addr().String(), strings.NewReader(""), &out)
+	require.ErrorContains(t, err, "(503)")
+}
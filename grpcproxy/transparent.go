@@ -0,0 +1,130 @@
+package grpcproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// transparent proxying (client side, Linux): connections redirected to the
+// listener by iptables are tunneled to their original destination
+//   - "redirect" mode is for `-j REDIRECT` (nat table), the destination is
+//     recovered with SO_ORIGINAL_DST
+//   - "tproxy" mode is for `-j TPROXY` (mangle table), the listener is
+//     IP_TRANSPARENT and the destination is the local address of the connection
+//   - the host name is peeked from TLS SNI or HTTP Host, so the pog server' logs
+//     and ACLs see names rather than IPs; protocols where the server speaks first
+//     go by IP after TransparentConfig.SniffTimeout
+const (
+	TransparentRedirect = "redirect"
+	TransparentTProxy   = "tproxy"
+)
+
+type TransparentConfig struct {
+	Mode         string        // TransparentRedirect or TransparentTProxy
+	SniffTimeout time.Duration // how long to wait for the client' first bytes, 0 disables peeking
+}
+
+var errTransparentUnsupported = errors.New("transparent proxying is supported on Linux only")
+
+// ListenTransparent listens on addr for connections redirected in cfg.Mode
+func ListenTransparent(addr string, cfg TransparentConfig) (net.Listener, error) {
+	switch cfg.Mode {
+	case TransparentRedirect:
+		return net.Listen("tcp", addr)
+	case TransparentTProxy:
+		return listenTProxy(addr)
+	}
+	return nil, fmt.Errorf("unknown transparent proxy mode %q", cfg.Mode)
+}
+
+func originalDst(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	if mode == TransparentTProxy {
+		addr, ok := conn.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("%T is not a TCP connection", conn)
+		}
+		return addr, nil
+	}
+
+	addr, err := getOriginalDst(conn)
+	if err != nil {
+		return nil, err
+	}
+	// the connection is to the listener itself, it would loop
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.Equal(addr.IP) && local.Port == addr.Port {
+		return nil, errors.New("not a redirected connection")
+	}
+	return addr, nil
+}
+
+// ServeTransparent tunnels connections accepted on l to their original destinations,
+// till l is closed
+func ServeTransparent(l net.Listener, pcc *ProxyClientContext, cfg TransparentConfig) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			dst, err := originalDst(conn, cfg.Mode)
+			if err != nil {
+				util.Errorf("transparent connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			handleTransparent(conn, pcc, dst, cfg.SniffTimeout)
+		}()
+	}
+}
+
+func handleTransparent(conn net.Conn, pcc *ProxyClientContext, dst *net.TCPAddr, sniffTimeout time.Duration) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hostPort := dst.String()
+	if sniffTimeout > 0 {
+		var name string
+		var err error
+		name, conn, err = sniffServerName(conn, sniffTimeout)
+		if err == nil {
+			hostPort = net.JoinHostPort(name, strconv.Itoa(dst.Port))
+		} else {
+			util.Debugf("transparent connection to %s: no host name: %v", dst, err)
+		}
+	}
+
+	var route tunnelRoute
+	logReq := func(code int) {
+		logRequest(LogRecord{
+			ConnectAddr: hostPort,
+			User:        "-",
+			RemoteAddr:  conn.RemoteAddr().String(),
+			Code:        strconv.Itoa(code),
+			Proto:       "TRANSPARENT",
+			Route:       pcc.routeLabel(route),
+			Server:      route.server,
+		})
+	}
+
+	stream, route, err := openRoutedTunnel(ctx, pcc, hostPort)
+	if err != nil {
+		util.Errorf("transparent connection to %s: %v", hostPort, err)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+	logReq(http.StatusOK)
+
+	handleBinaryTunneling(stream, conn, cancel, pcc.RateLimits.clientTunnelLimits(""))
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package grpcproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// getOriginalDst asks netfilter for the destination before REDIRECT
+func getOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a TCP connection", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	isIPv4 := false
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		isIPv4 = local.IP.To4() != nil
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// :TRICKY: getsockopt() fills struct sockaddr_in(6), and these are
+		// the getters of the same size
+		if isIPv4 {
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if sockErr == nil {
+				sa := mreq.Multiaddr
+				addr = &net.TCPAddr{
+					IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+					Port: int(binary.BigEndian.Uint16(sa[2:4])),
+				}
+			}
+			return
+		}
+
+		// IP6T_SO_ORIGINAL_DST is the same number
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if sockErr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			addr = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %v", sockErr)
+	}
+	return addr, nil
+}
+
+// listenTProxy listens with IP_TRANSPARENT, so connections to foreign
+// addresses are accepted (needs CAP_NET_ADMIN)
+func listenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				// a dual-stack socket needs both
+				err4 := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				err6 := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				if err4 != nil && err6 != nil {
+					sockErr = fmt.Errorf("IP_TRANSPARENT: %v", err4)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package grpcproxy
+
+import (
+	"net"
+)
+
+func getOriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTProxy(addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
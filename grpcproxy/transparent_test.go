@@ -0,0 +1,120 @@
+package grpcproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+)
+
+// startTransparent serves connections as if they were redirected from dst,
+// returns the listener address
+func startTransparent(t *testing.T, pcc *ProxyClientContext, dst *net.TCPAddr, sniffTimeout time.Duration) string {
+	l := grpctest.NewLocalListener()
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleTransparent(conn, pcc, dst, sniffTimeout)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestTransparentSniffing(t *testing.T) {
+	_, pcc := startLocalPOG(t)
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "plain")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
+	}))
+	defer secure.Close()
+
+	get := func(url string, port int) string {
+		// the original destination is unreachable (TEST-NET-1), so
+		// the tunnel works only if it goes by the host name
+		dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}
+		addr := startTransparent(t, pcc, dst, time.Second)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			Timeout: 5 * time.Second,
+		}
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	port := plain.Listener.Addr().(*net.TCPAddr).Port
+	require.Equal(t, "plain", get(fmt.Sprintf("http://localhost:%d/", port), port))
+
+	port = secure.Listener.Addr().(*net.TCPAddr).Port
+	require.Equal(t, "secure", get(fmt.Sprintf("https://localhost:%d/", port), port))
+}
+
+func TestTransparentServerFirst(t *testing.T) {
+	_, pcc := startLocalPOG(t)
+
+	// speaks first, like SMTP or MySQL
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "220 banner")
+			conn.Close()
+		}
+	}()
+
+	addr := startTransparent(t, pcc, l.Addr().(*net.TCPAddr), 100*time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "220 banner", string(b))
+}
+
+func TestTransparentNotRedirected(t *testing.T) {
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+
+	_, err = originalDst(accepted, TransparentRedirect)
+	require.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package grpcproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TunnelCaps limit concurrent tunnels per account and per peer IP, 0 is unlimited
+type TunnelCaps struct {
+	PerUser int
+	PerIP   int
+
+	accounts map[string]int // AuthItem.MaxTunnels, it wins over PerUser
+
+	mu    sync.Mutex
+	users map[string]int
+	ips   map[string]int
+}
+
+func NewTunnelCaps(perUser, perIP int, authLst []AuthItem) *TunnelCaps {
+	tc := &TunnelCaps{
+		PerUser:  perUser,
+		PerIP:    perIP,
+		accounts: map[string]int{},
+		users:    map[string]int{},
+		ips:      map[string]int{},
+	}
+
+	for _, ai := range authLst {
+		if ai.MaxTunnels > 0 {
+			tc.accounts[ai.Name] = ai.MaxTunnels
+		}
+	}
+
+	return tc
+}
+
+var tunnelsRejectedCnt = util.MakeCounterVecFunc(
+	"tunnels_rejected_total",
+	"Number of tunnels rejected by concurrent tunnel limits, by limit (user or ip)",
+)
+
+// Acquire takes a tunnel slot for user from ip ("" to skip the IP limit);
+// release() is to be called when the tunnel is over
+func (tc *TunnelCaps) Acquire(user, ip string) (release func(), err error) {
+	if tc == nil {
+		return func() {}, nil
+	}
+
+	userLimit := tc.PerUser
+	if limit, ok := tc.accounts[user]; ok {
+		userLimit = limit
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if userLimit > 0 && tc.users[user] >= userLimit {
+		tunnelsRejectedCnt("user", 1)
+		return nil, status.Errorf(codes.ResourceExhausted, "too many tunnels of %s, the limit is %d", user, userLimit)
+	}
+	if ip != "" && tc.PerIP > 0 && tc.ips[ip] >= tc.PerIP {
+		tunnelsRejectedCnt("ip", 1)
+		return nil, status.Errorf(codes.ResourceExhausted, "too many tunnels from %s, the limit is %d", ip, tc.PerIP)
+	}
+
+	tc.users[user]++
+	if ip != "" {
+		tc.ips[ip]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+
+			decrement(tc.users, user)
+			if ip != "" {
+				decrement(tc.ips, ip)
+			}
+		})
+	}, nil
+}
+
+// decrement keeps the map from growing with idle keys
+func decrement(m map[string]int, key string) {
+	if m[key] <= 1 {
+		delete(m, key)
+		return
+	}
+	m[key]--
+}
+
+// peerIP is the IP of the gRPC client, "" if unknown
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
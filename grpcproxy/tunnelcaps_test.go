@@ -0,0 +1,107 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelCapsAcquire(t *testing.T) {
+	tc := NewTunnelCaps(2, 1, []AuthItem{{Name: "vip", MaxTunnels: 3}})
+
+	release, err := tc.Acquire("user", "10.0.0.1")
+	require.NoError(t, err)
+	_, err = tc.Acquire("user", "10.0.0.1")
+	require.ErrorContains(t, err, "too many tunnels from 10.0.0.1")
+
+	_, err = tc.Acquire("user", "10.0.0.2")
+	require.NoError(t, err)
+	_, err = tc.Acquire("user", "10.0.0.3")
+	require.ErrorContains(t, err, "too many tunnels of user")
+
+	release()
+	release()
+	_, err = tc.Acquire("user", "10.0.0.1")
+	require.NoError(t, err)
+
+	for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"} {
+		_, err = tc.Acquire("vip", ip)
+		require.NoError(t, err)
+	}
+	_, err = tc.Acquire("vip", "10.0.1.4")
+	require.Error(t, err)
+}
+
+func connectStatus(t *testing.T, proxyURL *url.URL, addr string) (net.Conn, int) {
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	require.NoError(t, err)
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	require.NoError(t, err)
+
+	return conn, resp.StatusCode
+}
+
+func TestTunnelCapsLimits(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	check := func(proxyURL *url.URL) {
+		conn := dialCONNECT(t, proxyURL, echoAddr)
+
+		conn2, code := connectStatus(t, proxyURL, echoAddr)
+		conn2.Close()
+		require.Equal(t, http.StatusTooManyRequests, code)
+
+		// the slot is freed once the tunnel is over
+		conn.Close()
+		require.Eventually(t, func() bool {
+			conn, code := connectStatus(t, proxyURL, echoAddr)
+			conn.Close()
+			return code == http.StatusOK
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	// server side
+	cfg := makeTestServerConfig(t)
+	cfg.TunnelCaps = NewTunnelCaps(0, 1, nil)
+	proxyURL, _ := startLocalPOGWithConfig(t, cfg)
+	check(proxyURL)
+
+	// client side
+	proxyURL, pcc := startLocalPOG(t)
+	pcc.TunnelCaps = NewTunnelCaps(1, 0, nil)
+	check(proxyURL)
+}
+
+func TestTunnelCapsPlainHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+
+	proxyURL, pcc := startLocalPOG(t)
+	pcc.TunnelCaps = NewTunnelCaps(1, 0, nil)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func() int {
+		resp, err := client.Get(backend.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	conn := dialCONNECT(t, proxyURL, startEchoServer(t))
+	require.Equal(t, http.StatusTooManyRequests, get())
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return get() == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+}
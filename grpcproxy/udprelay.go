@@ -0,0 +1,429 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "git.catbo.net/muravjov/go2023/grpcproxy/proto/v1"
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+const maxDatagramSize = 64 * 1024
+
+const (
+	maxUDPDestinations = 1024
+	udpDestinationIdle = time.Minute
+)
+
+// udpDestinations caches destinations of a UDP association resolved and checked
+// already; it is bounded, so datagrams sprayed to many destinations do not grow memory
+type udpDestinations struct {
+	max   int
+	items map[string]*udpDestination
+}
+
+type udpDestination struct {
+	addr     *net.UDPAddr // nil for failed ones
+	lastUsed time.Time
+}
+
+func newUDPDestinations(max int) *udpDestinations {
+	return &udpDestinations{
+		max:   max,
+		items: map[string]*udpDestination{},
+	}
+}
+
+// get returns the destination of hostPort, ok is false if it is not cached
+func (ud *udpDestinations) get(hostPort string, now time.Time) (addr *net.UDPAddr, ok bool) {
+	d, ok := ud.items[hostPort]
+	if !ok {
+		return nil, false
+	}
+	d.lastUsed = now
+	return d.addr, true
+}
+
+func (ud *udpDestinations) put(hostPort string, addr *net.UDPAddr, now time.Time) {
+	if len(ud.items) >= ud.max {
+		ud.evict(now)
+	}
+	ud.items[hostPort] = &udpDestination{addr: addr, lastUsed: now}
+}
+
+// evict drops idle destinations, or the least recently used one if none is idle
+func (ud *udpDestinations) evict(now time.Time) {
+	var lru string
+	var lruTime time.Time
+	for hostPort, d := range ud.items {
+		if now.Sub(d.lastUsed) > udpDestinationIdle {
+			delete(ud.items, hostPort)
+			continue
+		}
+		if lru == "" || d.lastUsed.Before(lruTime) {
+			lru, lruTime = hostPort, d.lastUsed
+		}
+	}
+
+	if len(ud.items) >= ud.max {
+		delete(ud.items, lru)
+	}
+}
+
+func newDatagramPacket(hostPort string, payload []byte) *pb.Packet {
+	return &pb.Packet{
+		Union: &pb.Packet_Datagram{
+			Datagram: &pb.Datagram{
+				HostPort: hostPort,
+				Payload:  payload,
+			},
+		},
+	}
+}
+
+// udpConns are sockets of a UDP association: a dual-stack one, or one per
+// family of the egress source' addresses, so that both families are reachable
+type udpConns struct {
+	v4, v6 *net.UDPConn
+}
+
+// listenUDP opens sockets of a UDP association leaving from src, nil src is the system' choice
+func listenUDP(src *egressSource) (udpConns, error) {
+	if src == nil {
+		conn, err := net.ListenUDP("udp", nil)
+		return udpConns{conn, conn}, err
+	}
+
+	laddr4, laddr6, err := src.udpLocalAddrs()
+	if err != nil {
+		return udpConns{}, err
+	}
+
+	var uc udpConns
+	if laddr4 != nil {
+		uc.v4, err = net.ListenUDP("udp4", laddr4)
+		if err != nil {
+			return udpConns{}, err
+		}
+	}
+	if laddr6 != nil {
+		uc.v6, err = net.ListenUDP("udp6", laddr6)
+		if err != nil {
+			uc.Close()
+			return udpConns{}, err
+		}
+	}
+	return uc, nil
+}
+
+func (uc udpConns) list() []*net.UDPConn {
+	if uc.v4 == uc.v6 {
+		return []*net.UDPConn{uc.v4}
+	}
+
+	var lst []*net.UDPConn
+	for _, conn := range []*net.UDPConn{uc.v4, uc.v6} {
+		if conn != nil {
+			lst = append(lst, conn)
+		}
+	}
+	return lst
+}
+
+// forDst is the socket to reach dst from, nil if there is none of its family
+func (uc udpConns) forDst(dst net.IP) *net.UDPConn {
+	if dst.To4() != nil {
+		return uc.v4
+	}
+	return uc.v6
+}
+
+// String is the local addresses, for the access log
+func (uc udpConns) String() string {
+	var lst []string
+	for _, conn := range uc.list() {
+		lst = append(lst, conn.LocalAddr().String())
+	}
+	return strings.Join(lst, ",")
+}
+
+// egressIPs is the local IPs, for the access log
+func (uc udpConns) egressIPs() string {
+	var lst []string
+	for _, conn := range uc.list() {
+		lst = append(lst, conn.LocalAddr().(*net.UDPAddr).IP.String())
+	}
+	return strings.Join(lst, ",")
+}
+
+func (uc udpConns) Close() {
+	for _, conn := range uc.list() {
+		conn.Close()
+	}
+}
+
+// relayUDP is the server side of UDP association: Datagram packets are sent to
+// their destinations via conns (if resolve() allows), and replies are sent back to the stream;
+// the association ends when the stream ends, no datagrams pass for idleTimeout
+// or the quota is exhausted
+func relayUDP(stream Stream, conns udpConns, idleTimeout time.Duration, quota *quotaAccount, resolve func(hostPort string) (*net.UDPAddr, error)) {
+	TunnelingConnections.Inc()
+	defer TunnelingConnections.Dec()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	touch := func() {}
+	if idleTimeout > 0 {
+		idleTimer := time.AfterFunc(idleTimeout, cancel)
+		defer idleTimer.Stop()
+
+		touch = func() {
+			idleTimer.Reset(idleTimeout)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		// unblocks ReadFromUDP()
+		conns.Close()
+	}()
+
+	// destinations -> client
+	var sendMu sync.Mutex
+	for _, conn := range conns.list() {
+		go func(conn *net.UDPConn) {
+			defer cancel()
+
+			buf := make([]byte, maxDatagramSize)
+			for {
+				n, addr, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				touch()
+				if quota.Use(n) != nil {
+					return
+				}
+
+				payload := bytes.Clone(buf[:n])
+				sendMu.Lock()
+				err = Send(stream, newDatagramPacket(addr.String(), payload))
+				sendMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	// client -> destinations
+	go func() {
+		defer cancel()
+
+		// we resolve and check every destination once per association
+		// (till it is evicted)
+		destinations := newUDPDestinations(maxUDPDestinations)
+		for {
+			packet, err := Recv(stream)
+			if err != nil {
+				return
+			}
+
+			d, err := castFromUnion[*pb.Packet_Datagram](packet)
+			if err != nil {
+				return
+			}
+			touch()
+
+			hostPort := d.Datagram.HostPort
+			now := time.Now()
+			addr, ok := destinations.get(hostPort, now)
+			if !ok {
+				addr, err = resolve(hostPort)
+				if err != nil {
+					util.Debugf("dropping datagrams to %s: %v", hostPort, err)
+				}
+				destinations.put(hostPort, addr, now)
+			}
+
+			if addr == nil {
+				continue
+			}
+
+			conn := conns.forDst(addr.IP)
+			if conn == nil {
+				util.Debugf("dropping datagram to %s: no egress address of its family", hostPort)
+				continue
+			}
+			if _, err := conn.WriteToUDP(d.Datagram.Payload, addr); err != nil {
+				util.Debugf("dropping datagram to %s: %v", hostPort, err)
+			}
+			if quota.Use(len(d.Datagram.Payload)) != nil {
+				return
+			}
+		}
+	}()
+
+	<-ctx.Done()
+}
+
+// serveSOCKS5UDP is the client side of UDP association, see RFC 1928, section 7
+func serveSOCKS5UDP(ctx context.Context, conn net.Conn, br *bufio.Reader, pcc *ProxyClientContext, reply func(byte, net.Addr) error, logReq func(int)) {
+	var clientIP, localIP net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		util.Errorf("net.ListenUDP: %v", err)
+		reply(socks5RepGeneralFailure, nil)
+		logReq(http.StatusInternalServerError)
+		return
+	}
+	defer udpConn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	packet := &pb.Packet{
+		Union: &pb.Packet_UdpAssociateRequest{
+			UdpAssociateRequest: &pb.UDPAssociateRequest{},
+		},
+	}
+	stream, err := openStream(ctx, pcc, packet)
+	if err != nil {
+		reply(socks5ReplyCode(err), nil)
+		logReq(tunnelErrorCode(err))
+		return
+	}
+	defer closeSend(stream)
+
+	if err := reply(socks5RepSucceeded, udpConn.LocalAddr()); err != nil {
+		return
+	}
+	logReq(http.StatusOK)
+
+	TunnelingConnections.Inc()
+	defer TunnelingConnections.Dec()
+
+	// the association lasts as long as the control connection
+	go func() {
+		io.Copy(io.Discard, br)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		udpConn.Close()
+	}()
+
+	// the address datagrams come from, RFC says it is the only one to reply to
+	var clientAddr atomic.Pointer[net.UDPAddr]
+
+	// server -> client
+	go func() {
+		defer cancel()
+
+		for {
+			packet, err := Recv(stream)
+			if err != nil {
+				return
+			}
+
+			d, err := castFromUnion[*pb.Packet_Datagram](packet)
+			if err != nil {
+				return
+			}
+
+			addr := clientAddr.Load()
+			if addr == nil {
+				continue
+			}
+
+			// pog server reports the source as ip:port
+			srcAddr, err := net.ResolveUDPAddr("udp", d.Datagram.HostPort)
+			if err != nil {
+				continue
+			}
+
+			b := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, srcAddr)
+			b = append(b, d.Datagram.Payload...)
+			udpConn.WriteToUDP(b, addr)
+		}
+	}()
+
+	// client -> server
+	routes := udpRoutes{pcc: pcc, cache: map[string]bool{}}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if clientIP != nil && !addr.IP.Equal(clientIP) {
+			continue
+		}
+
+		// RSV(2) FRAG DST.ADDR DST.PORT DATA, fragmentation is not supported
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+		hostPort, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		// only a valid datagram may take over the reply address
+		clientAddr.Store(addr)
+
+		if !routes.allowed(ctx, hostPort) {
+			continue
+		}
+
+		payload := make([]byte, r.Len())
+		r.Read(payload)
+		if err := Send(stream, newDatagramPacket(hostPort, payload)); err != nil {
+			return
+		}
+	}
+}
+
+// udpRoutes applies ClientRouter and ServerRouter to datagrams of an association:
+// it goes via the default pog server, so destinations to be rejected, dialed
+// directly or reached via a named server are dropped
+type udpRoutes struct {
+	pcc   *ProxyClientContext
+	cache map[string]bool // by host:port
+}
+
+func (ur *udpRoutes) allowed(ctx context.Context, hostPort string) bool {
+	if ok, found := ur.cache[hostPort]; found {
+		return ok
+	}
+
+	route, _, _, _, server := ur.pcc.chooseRoute(ctx, hostPort)
+	ok := route.action == RoutePOG && server == nil
+	if !ok {
+		util.Debugf("dropping datagrams to %s: route %s %s", hostPort, route.action, route.server)
+	}
+
+	if len(ur.cache) >= maxUDPDestinations {
+		clear(ur.cache)
+	}
+	ur.cache[hostPort] = ok
+	return ok
+}
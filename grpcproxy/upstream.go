@@ -0,0 +1,210 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.catbo.net/muravjov/go2023/util"
+	"golang.org/x/net/proxy"
+)
+
+// upstreamProxy is a proxy the pog server connects to destinations through,
+// "http://[user:password@]host:port" (CONNECT) or "socks5://[user:password@]host:port"
+type upstreamProxy struct {
+	url *url.URL
+}
+
+func parseUpstreamProxy(s string) (*upstreamProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("upstream proxy %q: scheme must be http or socks5", u.Redacted())
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("upstream proxy %q: port is missing", u.Redacted())
+	}
+
+	return &upstreamProxy{u}, nil
+}
+
+func (up *upstreamProxy) String() string {
+	return up.url.Redacted()
+}
+
+func (up *upstreamProxy) dial(ctx context.Context, hostPort string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if up.url.Scheme == "socks5" {
+		conn, err = up.dialSOCKS5(ctx, hostPort)
+	} else {
+		conn, err = up.dialCONNECT(ctx, hostPort)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy %s: %w", up, err)
+	}
+	return conn, nil
+}
+
+func (up *upstreamProxy) dialSOCKS5(ctx context.Context, hostPort string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user := up.url.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", up.url.Host, auth, &net.Dialer{Timeout: destDialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", hostPort)
+}
+
+func (up *upstreamProxy) dialCONNECT(ctx context.Context, hostPort string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: destDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", up.url.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is bounded by ctx too
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: hostPort},
+		Host:   hostPort,
+		Header: http.Header{},
+	}
+	if user := up.url.User; user != nil {
+		password, _ := user.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// :TRICKY: 2xx to CONNECT has no body whatever the headers say (RFC 9110),
+	// so resp.Body is not to be touched
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", hostPort, resp.Status)
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+
+	// the destination may have spoken already
+	return &bufferedConn{conn, br}, nil
+}
+
+type upstreamRule struct {
+	rule   ACLRule
+	direct bool
+}
+
+// UpstreamRouter chooses between the upstream proxy and direct connections by
+// rules "direct <ACL rule>" or "upstream <ACL rule>", the first matching rule wins;
+// destinations matching no rule go via the upstream
+type UpstreamRouter struct {
+	proxy *upstreamProxy
+	rules []upstreamRule
+}
+
+// NewUpstreamRouter returns nil if there is no upstream proxy
+func NewUpstreamRouter(proxyURL string, rules []string) (*UpstreamRouter, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+
+	up, err := parseUpstreamProxy(proxyURL)
+	if err != nil {
+		util.Error(err)
+		return nil, err
+	}
+	router := &UpstreamRouter{proxy: up}
+
+	for _, s := range rules {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		action, ruleText, _ := strings.Cut(s, " ")
+		var r upstreamRule
+		switch action {
+		case "direct":
+			r.direct = true
+		case "upstream":
+		default:
+			err := fmt.Errorf("upstream rule %q: must start with direct or upstream", s)
+			util.Error(err)
+			return nil, err
+		}
+
+		r.rule, err = ParseACLRule(strings.TrimSpace(ruleText))
+		if err != nil {
+			util.Error(err)
+			return nil, err
+		}
+		router.rules = append(router.rules, r)
+	}
+
+	return router, nil
+}
+
+// Route returns the upstream proxy for the destination, nil for direct connections
+func (router *UpstreamRouter) Route(host string, ips []net.IP, port int) *upstreamProxy {
+	if router == nil {
+		return nil
+	}
+
+	for _, r := range router.rules {
+		if r.rule.Match(host, ips, port) {
+			if r.direct {
+				return nil
+			}
+			break
+		}
+	}
+	return router.proxy
+}
+
+// NeedsIPs tells if CIDR rules need the destination to be resolved
+func (router *UpstreamRouter) NeedsIPs() bool {
+	if router == nil {
+		return false
+	}
+
+	for _, r := range router.rules {
+		if r.rule.cidr != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package grpcproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/grpctest"
+	"github.com/stretchr/testify/require"
+)
+
+// startWhoAmIServer runs a server which tells the peer its address once asked,
+// so that the answer does not race with the CONNECT response
+func startWhoAmIServer(t *testing.T) string {
+	l := grpctest.NewLocalListener()
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Read(make([]byte, 1))
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			fmt.Fprint(conn, host)
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// whoAmI asks startWhoAmIServer() through the proxy
+func whoAmI(t *testing.T, proxyURL *url.URL, addr string) string {
+	conn := dialCONNECT(t, proxyURL, addr)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("?"))
+	require.NoError(t, err)
+	b, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// startStandInUpstream runs a local pog as the upstream proxy: it speaks both
+// HTTP CONNECT and SOCKS5, requires user:secret and connects from 127.0.0.2
+func startStandInUpstream(t *testing.T) *url.URL {
+	var err error
+	cfg := makeTestServerConfig(t)
+	cfg.EgressSource, err = NewEgressSourcePolicy([]string{"127.0.0.2"}, nil)
+	require.NoError(t, err)
+	proxyURL, pcc := startLocalPOGWithConfig(t, cfg)
+
+	hash, err := hashPassword("secret")
+	require.NoError(t, err)
+	pcc.AuthLst = []AuthItem{{Name: "user", Hash: hash, ExpDate: time.Now().Add(time.Hour)}}
+
+	return proxyURL
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	addr := startWhoAmIServer(t)
+	upstreamURL := startStandInUpstream(t)
+
+	var guard *EgressGuard
+	startWithUpstream := func(proxyURL string, rules ...string) *url.URL {
+		var err error
+		cfg := makeTestServerConfig(t)
+		cfg.EgressGuard = guard
+		cfg.Upstream, err = NewUpstreamRouter(proxyURL, rules)
+		require.NoError(t, err)
+
+		frontURL, _ := startLocalPOGWithConfig(t, cfg)
+		return frontURL
+	}
+
+	for _, scheme := range []string{"http", "socks5"} {
+		frontURL := startWithUpstream(scheme + "://user:secret@" + upstreamURL.Host)
+		require.Equal(t, "127.0.0.2", whoAmI(t, frontURL, addr), scheme)
+
+		frontURL = startWithUpstream(scheme + "://user:wrong@" + upstreamURL.Host)
+		conn, code := connectStatus(t, frontURL, addr)
+		conn.Close()
+		require.Equal(t, http.StatusServiceUnavailable, code, scheme)
+	}
+
+	// the first matching rule wins
+	frontURL := startWithUpstream("http://user:secret@"+upstreamURL.Host, "upstream *:1", "direct 127.0.0.0/8")
+	require.Equal(t, "127.0.0.1", whoAmI(t, frontURL, addr))
+
+	// host names go to the upstream as they are: it resolves them on its own,
+	// and the guard has nothing to say about addresses of its network
+	guard, err := NewEgressGuard("", 0)
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(addr)
+	for _, scheme := range []string{"http", "socks5"} {
+		frontURL := startWithUpstream(scheme + "://user:secret@" + upstreamURL.Host)
+		require.Equal(t, "127.0.0.2", whoAmI(t, frontURL, net.JoinHostPort("localhost", port)), scheme)
+	}
+
+	hosts := make(chan string, 1)
+	l := grpctest.NewLocalListener()
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		hosts <- req.Host
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	}()
+	frontURL = startWithUpstream("http://" + l.Addr().String())
+	conn, code := connectStatus(t, frontURL, "no-such-host.invalid:443")
+	conn.Close()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "no-such-host.invalid:443", <-hosts)
+
+	_, err = NewUpstreamRouter("ftp://proxy:21", nil)
+	require.Error(t, err)
+	_, err = NewUpstreamRouter("http://proxy:3128", []string{"maybe *"})
+	require.Error(t, err)
+}
@@ -0,0 +1,175 @@
+package grpcproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.catbo.net/muravjov/go2023/util"
+)
+
+// UsageStore keeps traffic usage of accounts per quota period, see Quotas
+type UsageStore interface {
+	// Add adds n bytes to the usage of account in period and returns the new total;
+	// the account' earlier periods are dropped
+	Add(account, period string, n int64) (int64, error)
+	Get(account, period string) (int64, error)
+	Close() error
+}
+
+// MemoryUsageStore loses the usage on restart, it is good for tests
+type MemoryUsageStore struct {
+	mu    sync.Mutex
+	usage map[string]map[string]int64 // account -> period -> bytes
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{
+		usage: map[string]map[string]int64{},
+	}
+}
+
+func (ms *MemoryUsageStore) Add(account, period string, n int64) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	periods, ok := ms.usage[account]
+	if !ok {
+		periods = map[string]int64{}
+		ms.usage[account] = periods
+	}
+	// past periods are over, their keys sort before the current one, see periodKey()
+	for p := range periods {
+		if p < period {
+			delete(periods, p)
+		}
+	}
+	periods[period] += n
+
+	return periods[period], nil
+}
+
+func (ms *MemoryUsageStore) Get(account, period string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.usage[account][period], nil
+}
+
+func (ms *MemoryUsageStore) Close() error {
+	return nil
+}
+
+// FileUsageStore is MemoryUsageStore saved to a JSON file every flushInterval
+// and on Close(); the file is replaced atomically, so a crash loses
+// flushInterval of accounting at most
+type FileUsageStore struct {
+	MemoryUsageStore
+
+	path  string
+	dirty bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewFileUsageStore(path string, flushInterval time.Duration) (*FileUsageStore, error) {
+	fs := &FileUsageStore{
+		MemoryUsageStore: *NewMemoryUsageStore(),
+		path:             path,
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		util.Errorf("failed to read usage file: %v", err)
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &fs.usage); err != nil {
+			util.Errorf("failed to parse usage file %s: %v", path, err)
+			return nil, err
+		}
+	}
+
+	go func() {
+		defer close(fs.done)
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fs.Flush()
+			case <-fs.stop:
+				return
+			}
+		}
+	}()
+
+	return fs, nil
+}
+
+func (fs *FileUsageStore) Add(account, period string, n int64) (int64, error) {
+	total, err := fs.MemoryUsageStore.Add(account, period, n)
+
+	fs.mu.Lock()
+	fs.dirty = true
+	fs.mu.Unlock()
+
+	return total, err
+}
+
+// Flush writes the usage to the file if it has changed
+func (fs *FileUsageStore) Flush() error {
+	fs.mu.Lock()
+	if !fs.dirty {
+		fs.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(fs.usage)
+	fs.dirty = false
+	fs.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomically(fs.path, b)
+	}
+	if err != nil {
+		util.Errorf("failed to save usage file: %v", err)
+
+		fs.mu.Lock()
+		fs.dirty = true
+		fs.mu.Unlock()
+	}
+	return err
+}
+
+func (fs *FileUsageStore) Close() error {
+	close(fs.stop)
+	<-fs.done
+
+	return fs.Flush()
+}
+
+func writeFileAtomically(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -21,3 +23,15 @@ func BoolEnv(variable *bool, name string, defValue bool) {
 	viper.SetDefault(name, defValue)
 	*variable = viper.GetBool(name)
 }
+
+func IntEnv(variable *int, name string, defValue int) {
+	bindEnv(name)
+	viper.SetDefault(name, defValue)
+	*variable = viper.GetInt(name)
+}
+
+func DurationEnv(variable *time.Duration, name string, defValue time.Duration) {
+	bindEnv(name)
+	viper.SetDefault(name, defValue)
+	*variable = viper.GetDuration(name)
+}
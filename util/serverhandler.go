@@ -3,6 +3,7 @@ package util
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -72,6 +73,17 @@ func (handler *ServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
 func ListenAndServe(server *http.Server, beforeShutdown func()) bool {
+	return serveUntilSignal(server, server.ListenAndServe, beforeShutdown)
+}
+
+// Serve is ListenAndServe() for an already created listener
+func Serve(server *http.Server, listener net.Listener, beforeShutdown func()) bool {
+	return serveUntilSignal(server, func() error {
+		return server.Serve(listener)
+	}, beforeShutdown)
+}
+
+func serveUntilSignal(server *http.Server, serve func() error, beforeShutdown func()) bool {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 	var servicesWg sync.WaitGroup
@@ -80,7 +92,7 @@ func ListenAndServe(server *http.Server, beforeShutdown func()) bool {
 	servicesWg.Add(1)
 	go func() {
 		defer servicesWg.Done()
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
 			Error(err)
 			serverOk = false
 		}